@@ -0,0 +1,379 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+// The catalog is an append-only log of every archive uploaded from this
+// machine, one JSON record per line. Glacier's own inventories are a day
+// behind, so this is the only immediate record of what's in a vault.
+const catalogFileName = "catalog.jsonl"
+
+var catalogMu sync.Mutex
+
+// inventorySnapshot is the last inventory of a vault downloaded from Glacier.
+type inventorySnapshot struct {
+	Vault         string             `json:"vault"`
+	Region        string             `json:"region"`
+	InventoryDate time.Time          `json:"inventory_date"`
+	RetrievedAt   time.Time          `json:"retrieved_at"`
+	Archives      []inventoryArchive `json:"archives"`
+}
+
+// inventoryArchive is one archive in an inventory.
+type inventoryArchive struct {
+	ArchiveID    string    `json:"archive_id"`
+	Description  string    `json:"description"`
+	CreationDate time.Time `json:"creation_date"`
+	Size         int64     `json:"size"`
+	TreeHash     string    `json:"tree_hash"`
+}
+
+// catalogRecord is one archive in the catalog.
+type catalogRecord struct {
+	Vault       string    `json:"vault"`
+	Region      string    `json:"region"`
+	ArchiveID   string    `json:"archive_id"`
+	TreeHash    string    `json:"tree_hash"`
+	Size        int64     `json:"size"`
+	Description string    `json:"description"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+	// the local file the archive came from, if there was one
+	Path    string      `json:"path,omitempty"`
+	ModTime time.Time   `json:"mod_time,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+}
+
+func catalogFile() (string, error) {
+	dir, err := glacierDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, catalogFileName), nil
+}
+
+// recordUpload adds a newly created archive to the catalog. fp is the local
+// file it came from, or empty for streams.
+func recordUpload(result *glacier.ArchiveCreationOutput, desc string, size int64, treeHash string, fp string) error {
+	rec := catalogRecord{
+		Vault:       vault,
+		Region:      region,
+		ArchiveID:   *result.ArchiveId,
+		TreeHash:    treeHash,
+		Size:        size,
+		Description: desc,
+		UploadedAt:  time.Now().UTC(),
+	}
+
+	if fp != "" {
+		abs, err := filepath.Abs(fp)
+		if err != nil {
+			return err
+		}
+		stats, err := os.Stat(fp)
+		if err != nil {
+			return err
+		}
+		rec.Path = abs
+		rec.ModTime = stats.ModTime()
+		rec.Mode = stats.Mode()
+	}
+
+	return appendCatalog(rec)
+}
+
+// appendCatalog writes the record as a single line. A crash or a full disk can
+// still cut the write short, so a torn last line left behind by an earlier
+// append is cut off first and readCatalog skips one it finds.
+func appendCatalog(rec catalogRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	file, err := catalogFile()
+	if err != nil {
+		return err
+	}
+
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := trimTornLine(f); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readCatalog returns every record in the order they were added.
+func readCatalog() ([]catalogRecord, error) {
+	file, err := catalogFile()
+	if err != nil {
+		return nil, err
+	}
+
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		records []catalogRecord
+		corrupt error
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		// only the last line can be torn, anything before it is real damage
+		if corrupt != nil {
+			return nil, corrupt
+		}
+
+		var rec catalogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			corrupt = fmt.Errorf("corrupt catalog %s line %d | %s", file, line, err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if corrupt != nil {
+		fmt.Fprintf(os.Stderr, "Skipping the last line of the catalog, it was only partly written | %s\n", corrupt)
+	}
+	return records, nil
+}
+
+// trimTornLine cuts off the end of f after its last newline, which is what's
+// left of an append that didn't finish.
+func trimTornLine(f *os.File) error {
+	stats, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	end := stats.Size()
+	buf := make([]byte, 4096)
+	for end > 0 {
+		n := int64(len(buf))
+		if end < n {
+			n = end
+		}
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end += int64(i) + 1 - n
+			break
+		}
+		end -= n
+	}
+
+	if end == stats.Size() {
+		return nil
+	}
+	return f.Truncate(end)
+}
+
+func snapshotFile(region string, vault string) (string, error) {
+	dir, err := glacierDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "inventories", region, vault+".json"), nil
+}
+
+// loadSnapshot returns nil if the vault has never been inventoried.
+func loadSnapshot(region string, vault string) (*inventorySnapshot, error) {
+	file, err := snapshotFile(region, vault)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snap inventorySnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return nil, fmt.Errorf("corrupt inventory %s | %s", file, err)
+	}
+	return &snap, nil
+}
+
+// saveSnapshot replaces the vault's last inventory.
+func saveSnapshot(snap *inventorySnapshot) error {
+	file, err := snapshotFile(snap.Region, snap.Vault)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, b)
+}
+
+// archiveSize looks an archive up in the catalog and the vault's last
+// inventory, returning -1 if it's in neither.
+func archiveSize(region string, vault string, archiveID string) (int64, error) {
+	records, err := readCatalog()
+	if err != nil {
+		return 0, err
+	}
+	for _, rec := range records {
+		if rec.Region == region && rec.Vault == vault && rec.ArchiveID == archiveID {
+			return rec.Size, nil
+		}
+	}
+
+	snap, err := loadSnapshot(region, vault)
+	if err != nil || snap == nil {
+		return -1, err
+	}
+	for _, a := range snap.Archives {
+		if a.ArchiveID == archiveID {
+			return a.Size, nil
+		}
+	}
+	return -1, nil
+}
+
+// pendingJob is a retrieval job that's been started but not yet downloaded.
+type pendingJob struct {
+	JobID       string    `json:"job_id"`
+	Vault       string    `json:"vault"`
+	Region      string    `json:"region"`
+	ArchiveID   string    `json:"archive_id"`
+	Tier        string    `json:"tier"`
+	Range       string    `json:"range,omitempty"`
+	Output      string    `json:"output,omitempty"`
+	InitiatedAt time.Time `json:"initiated_at"`
+}
+
+func pendingJobsFile() (string, error) {
+	dir, err := glacierDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "jobs.json"), nil
+}
+
+func loadPendingJobs() ([]pendingJob, error) {
+	file, err := pendingJobsFile()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []pendingJob
+	if err := json.Unmarshal(b, &jobs); err != nil {
+		return nil, fmt.Errorf("corrupt job list %s | %s", file, err)
+	}
+	return jobs, nil
+}
+
+// updatePendingJobs applies fn to the list of pending jobs and saves the result.
+func updatePendingJobs(fn func([]pendingJob) []pendingJob) error {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	jobs, err := loadPendingJobs()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(fn(jobs), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := pendingJobsFile()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, b)
+}
+
+func addPendingJob(job pendingJob) error {
+	return updatePendingJobs(func(jobs []pendingJob) []pendingJob {
+		return append(jobs, job)
+	})
+}
+
+func removePendingJob(jobID string) error {
+	return updatePendingJobs(func(jobs []pendingJob) []pendingJob {
+		var kept []pendingJob
+		for _, job := range jobs {
+			if job.JobID != jobID {
+				kept = append(kept, job)
+			}
+		}
+		return kept
+	})
+}
+
+// findPendingJob returns the most recent job retrieving the archive (or the
+// given range of it), or nil.
+func findPendingJob(vault string, region string, archiveID string, byteRange string) (*pendingJob, error) {
+	jobs, err := loadPendingJobs()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(jobs) - 1; i >= 0; i-- {
+		if jobs[i].Vault == vault && jobs[i].Region == region && jobs[i].ArchiveID == archiveID && jobs[i].Range == byteRange {
+			return &jobs[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadCatalogTornLine(t *testing.T) {
+	home, err := ioutil.TempDir("", "glacier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	for _, id := range []string{"a", "b"} {
+		if err := appendCatalog(catalogRecord{Vault: "photos", ArchiveID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := catalogFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRaw := func(s string) {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the process died halfway through writing a record
+	appendRaw(`{"vault":"photos","archi`)
+	records, err := readCatalog()
+	if err != nil {
+		t.Fatalf("readCatalog failed | %s", err)
+	}
+	if len(records) != 2 {
+		t.Errorf("read %d record(s), expected 2", len(records))
+	}
+
+	// the next append replaces what's left of it
+	if err := appendCatalog(catalogRecord{Vault: "photos", ArchiveID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	records, err = readCatalog()
+	if err != nil {
+		t.Fatalf("readCatalog failed | %s", err)
+	}
+	if len(records) != 3 || records[2].ArchiveID != "c" {
+		t.Errorf("records = %v, expected a, b and c", records)
+	}
+
+	// damage before the last line isn't a torn write
+	appendRaw("not json\n")
+	if err := appendCatalog(catalogRecord{Vault: "photos", ArchiveID: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readCatalog(); err == nil {
+		t.Error("expected an error for a corrupt line in the middle of the catalog")
+	}
+}
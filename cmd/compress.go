@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// codec compresses archives on the way up and decompresses them on the way back.
+type codec struct {
+	compress   func(io.Writer) (io.WriteCloser, error)
+	decompress func(io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{
+	"gzip": {
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	"zstd": {
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+}
+
+func codecNames() string {
+	var names []string
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
+func lookupCodec(name string) (codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return codec{}, fmt.Errorf("unsupported compression: %s (expected %s)", name, codecNames())
+	}
+	return c, nil
+}
+
+// compressStream returns r compressed with the named codec, compressed on the
+// fly as it's read. Closing the reader stops the compression.
+func compressStream(r io.Reader, name string) (*io.PipeReader, error) {
+	c, err := lookupCodec(name)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := c.compress(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	return pr, nil
+}
+
+// decompressStream undoes compressStream.
+func decompressStream(r io.Reader, name string) (io.ReadCloser, error) {
+	c, err := lookupCodec(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.decompress(r)
+}
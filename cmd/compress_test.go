@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompressStream(t *testing.T) {
+	data := bytes.Repeat([]byte("glacier "), 100000)
+
+	for name := range codecs {
+		r, err := compressStream(bytes.NewReader(data), name)
+		if err != nil {
+			t.Fatalf("%s: compressStream failed | %s", name, err)
+		}
+		compressed, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: compressStream failed | %s", name, err)
+		}
+		if len(compressed) >= len(data) {
+			t.Errorf("%s: compressed size = %d, expected less than %d", name, len(compressed), len(data))
+		}
+
+		d, err := decompressStream(bytes.NewReader(compressed), name)
+		if err != nil {
+			t.Fatalf("%s: decompressStream failed | %s", name, err)
+		}
+		b, err := ioutil.ReadAll(d)
+		d.Close()
+		if err != nil {
+			t.Fatalf("%s: decompressStream failed | %s", name, err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("%s: round trip changed the data", name)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/spf13/cobra"
+)
+
+const pricingFileName = "pricing.json"
+
+var (
+	costPrefix     string
+	costArchiveIDs []string
+	costTier       string
+	costOutput     string
+)
+
+var costCmd = &cobra.Command{
+	Use:   "cost",
+	Short: "Estimate what retrieving archives will cost and how long it'll take",
+	Long: `Sizes come from the local catalog and the last inventory of the vault. Every
+archive is estimated unless --archive-id or --prefix narrow it down.
+
+The vault's data retrieval policy and any provisioned capacity are taken into
+account. Prices are read from ~/.glacier/` + pricingFileName + `, which is created
+with us-east-1's prices the first time it's needed and can be edited to match
+your region or current pricing.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sizes, err := costSizes()
+		if err != nil {
+			return err
+		}
+		if len(sizes) == 0 {
+			return fmt.Errorf("no archives to estimate, check the catalog or run inventory first")
+		}
+
+		estimates, err := estimateTiers(sizes, costTier)
+		if err != nil {
+			return err
+		}
+		return printEstimates(estimates, costOutput)
+	},
+}
+
+func init() {
+	costCmd.Flags().StringVarP(&vault, "vault", "v", "", "Vault name")
+	err := costCmd.MarkFlagRequired("vault")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	costCmd.Flags().StringSliceVarP(&costArchiveIDs, "archive-id", "a", nil, "Only these archives (can be repeated)")
+	costCmd.Flags().StringVarP(&costPrefix, "prefix", "p", "", "Only files that were uploaded from under this path")
+	costCmd.Flags().StringVar(&costTier, "tier", "", "Only this retrieval tier (Expedited, Standard, Bulk)")
+	costCmd.Flags().StringVarP(&costOutput, "output", "o", "table", "Output format (table, json)")
+}
+
+// tierPricing is what one retrieval tier costs and how long it usually takes.
+type tierPricing struct {
+	PerGB              float64 `json:"per_gb"`
+	PerThousandRequest float64 `json:"per_1000_requests"`
+	MinHours           float64 `json:"min_hours"`
+	MaxHours           float64 `json:"max_hours"`
+}
+
+// pricing is keyed by region, with "default" for regions that aren't listed.
+type pricing map[string]struct {
+	Currency string                 `json:"currency"`
+	Tiers    map[string]tierPricing `json:"tiers"`
+}
+
+// us-east-1's prices for Glacier vaults when this was written
+const defaultPricing = `{
+  "default": {
+    "currency": "USD",
+    "tiers": {
+      "Expedited": {"per_gb": 0.03, "per_1000_requests": 10.00, "min_hours": 0.0167, "max_hours": 0.0833},
+      "Standard": {"per_gb": 0.01, "per_1000_requests": 0.05, "min_hours": 3, "max_hours": 5},
+      "Bulk": {"per_gb": 0.0025, "per_1000_requests": 0.025, "min_hours": 5, "max_hours": 12}
+    }
+  }
+}
+`
+
+// loadPricing reads the pricing table, writing out the defaults if there isn't
+// one yet.
+func loadPricing() (pricing, error) {
+	dir, err := glacierDir()
+	if err != nil {
+		return nil, err
+	}
+	file := filepath.Join(dir, pricingFileName)
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		b = []byte(defaultPricing)
+		err = writeFileAtomic(file, b)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p pricing
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("corrupt pricing table %s | %s", file, err)
+	}
+	return p, nil
+}
+
+// retrievalLimits are the account's limits on how fast archives can be
+// retrieved.
+type retrievalLimits struct {
+	// None, FreeTier or BytesPerHour
+	Strategy     string
+	BytesPerHour int64
+	// provisioned capacity units that haven't expired
+	CapacityUnits int
+}
+
+func fetchRetrievalLimits(svc *glacier.Glacier) (retrievalLimits, error) {
+	limits := retrievalLimits{Strategy: "None"}
+
+	policy, err := svc.GetDataRetrievalPolicy(&glacier.GetDataRetrievalPolicyInput{
+		AccountId: aws.String("-"),
+	})
+	if err != nil {
+		return limits, formatAWSError(err)
+	}
+	if policy.Policy != nil && len(policy.Policy.Rules) > 0 {
+		rule := policy.Policy.Rules[0]
+		limits.Strategy = aws.StringValue(rule.Strategy)
+		limits.BytesPerHour = aws.Int64Value(rule.BytesPerHour)
+	}
+
+	capacity, err := svc.ListProvisionedCapacity(&glacier.ListProvisionedCapacityInput{
+		AccountId: aws.String("-"),
+	})
+	if err != nil {
+		return limits, formatAWSError(err)
+	}
+	for _, c := range capacity.ProvisionedCapacityList {
+		expires, err := time.Parse(time.RFC3339, aws.StringValue(c.ExpirationDate))
+		if err != nil || expires.After(time.Now()) {
+			limits.CapacityUnits++
+		}
+	}
+	return limits, nil
+}
+
+// retrievalEstimate is the cost and time to retrieve some archives with one
+// tier.
+type retrievalEstimate struct {
+	Tier         string   `json:"tier"`
+	Archives     int      `json:"archives"`
+	Bytes        int64    `json:"bytes"`
+	Currency     string   `json:"currency"`
+	RetrievalFee float64  `json:"retrieval_fee"`
+	RequestFee   float64  `json:"request_fee"`
+	Total        float64  `json:"total"`
+	MinHours     float64  `json:"min_hours"`
+	MaxHours     float64  `json:"max_hours"`
+	Notes        []string `json:"notes,omitempty"`
+}
+
+// each unit of provisioned capacity allows this many expedited retrievals
+// every 5 minutes, at up to 150MB/s
+const (
+	capacityRetrievals   = 3
+	capacityBytesPerHour = 150e6 * 3600
+)
+
+// expeditedSizeLimit is the largest archive expedited retrievals are quick for.
+const expeditedSizeLimit = 250 << 20
+
+// estimateRetrieval works out what retrieving archives of the given sizes with
+// one tier costs and how long until all of them are available.
+func estimateRetrieval(sizes []int64, tier string, currency string, p tierPricing, limits retrievalLimits) retrievalEstimate {
+	e := retrievalEstimate{
+		Tier:     tier,
+		Archives: len(sizes),
+		Currency: currency,
+		MinHours: p.MinHours,
+		MaxHours: p.MaxHours,
+	}
+
+	var largest int64
+	for _, size := range sizes {
+		e.Bytes += size
+		if size > largest {
+			largest = size
+		}
+	}
+
+	e.RetrievalFee = float64(e.Bytes) / (1 << 30) * p.PerGB
+	e.RequestFee = float64(len(sizes)) / 1000 * p.PerThousandRequest
+	e.Total = e.RetrievalFee + e.RequestFee
+
+	// jobs that can't all be started at once hold up the last archive
+	spread := func(hours float64) {
+		e.MinHours = math.Max(e.MinHours, hours)
+		e.MaxHours = hours + p.MaxHours
+	}
+
+	if tier == "Expedited" {
+		if limits.CapacityUnits == 0 {
+			e.Notes = append(e.Notes, "no provisioned capacity, expedited retrievals may be rejected when demand is high")
+		} else {
+			units := float64(limits.CapacityUnits)
+			batches := math.Ceil(float64(len(sizes))/(capacityRetrievals*units)) - 1
+			spread(math.Max(batches*5/60, float64(e.Bytes)/(capacityBytesPerHour*units)))
+			e.Notes = append(e.Notes, fmt.Sprintf("%d unit(s) of provisioned capacity, which isn't included in the cost", limits.CapacityUnits))
+		}
+		if largest > expeditedSizeLimit {
+			e.Notes = append(e.Notes, fmt.Sprintf("archives over %s can take longer than usual to retrieve", formatSize(expeditedSizeLimit)))
+		}
+		return e
+	}
+
+	switch limits.Strategy {
+	case "FreeTier":
+		e.Notes = append(e.Notes, "the data retrieval policy only allows the free tier, retrievals past it will be rejected")
+	case "BytesPerHour":
+		if limits.BytesPerHour > 0 {
+			hours := float64(e.Bytes) / float64(limits.BytesPerHour)
+			spread(hours)
+			e.Notes = append(e.Notes, fmt.Sprintf("the data retrieval policy allows %s an hour, so jobs have to be spread over %.1f hour(s)", formatSize(limits.BytesPerHour), hours))
+		}
+	}
+	return e
+}
+
+// estimateTiers estimates every tier, or just the given one.
+func estimateTiers(sizes []int64, tier string) ([]retrievalEstimate, error) {
+	selected := tiers
+	if tier != "" {
+		if !validTier(tier) {
+			return nil, fmt.Errorf("invalid tier: %s (want one of %s)", tier, strings.Join(tiers, ", "))
+		}
+		selected = []string{tier}
+	}
+
+	table, err := loadPricing()
+	if err != nil {
+		return nil, err
+	}
+	prices, ok := table[region]
+	if !ok {
+		prices, ok = table["default"]
+	}
+	if !ok {
+		return nil, fmt.Errorf("no prices for %s (or a default) in the pricing table", region)
+	}
+
+	limits, err := fetchRetrievalLimits(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	var estimates []retrievalEstimate
+	for _, t := range selected {
+		p, ok := prices.Tiers[t]
+		if !ok {
+			return nil, fmt.Errorf("no %s prices for %s in the pricing table", t, region)
+		}
+		estimates = append(estimates, estimateRetrieval(sizes, t, prices.Currency, p, limits))
+	}
+	return estimates, nil
+}
+
+// costSizes looks up the sizes of the archives picked by the cost flags.
+func costSizes() ([]int64, error) {
+	var sizes []int64
+
+	switch {
+	case len(costArchiveIDs) > 0:
+		for _, id := range costArchiveIDs {
+			size, err := archiveSize(region, vault, id)
+			if err != nil {
+				return nil, err
+			}
+			if size < 0 {
+				return nil, fmt.Errorf("archive %s isn't in the catalog or inventory", id)
+			}
+			sizes = append(sizes, size)
+		}
+	case costPrefix != "":
+		files, err := restoreFiles(costPrefix, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			sizes = append(sizes, f.rec.Size)
+		}
+	default:
+		archives, err := listArchives("all")
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range archives {
+			sizes = append(sizes, a.Size)
+		}
+	}
+	return sizes, nil
+}
+
+func printEstimates(estimates []retrievalEstimate, output string) error {
+	switch output {
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIER\tARCHIVES\tSIZE\tRETRIEVAL\tREQUESTS\tTOTAL\tAVAILABLE IN")
+		for _, e := range estimates {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%.2f %s\t%.2f %s\t%.2f %s\t%s - %s\n", e.Tier, e.Archives, formatSize(e.Bytes),
+				e.RetrievalFee, e.Currency, e.RequestFee, e.Currency, e.Total, e.Currency, formatHours(e.MinHours), formatHours(e.MaxHours))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		for _, e := range estimates {
+			for _, note := range e.Notes {
+				fmt.Printf("%s: %s\n", e.Tier, note)
+			}
+		}
+		return nil
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(estimates)
+	default:
+		return fmt.Errorf("invalid output: %s", output)
+	}
+}
+
+// formatHours rounds to the minute, e.g. 5m or 3h30m.
+func formatHours(h float64) string {
+	minutes := int64(math.Round(h * 60))
+	if minutes < 60 {
+		return fmt.Sprintf("%dm", minutes)
+	}
+	if minutes%60 == 0 {
+		return fmt.Sprintf("%dh", minutes/60)
+	}
+	return fmt.Sprintf("%dh%dm", minutes/60, minutes%60)
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEstimateRetrieval(t *testing.T) {
+	p := tierPricing{PerGB: 0.01, PerThousandRequest: 0.05, MinHours: 3, MaxHours: 5}
+	sizes := []int64{1 << 30, 3 << 30}
+
+	e := estimateRetrieval(sizes, "Standard", "USD", p, retrievalLimits{Strategy: "None"})
+	if math.Abs(e.RetrievalFee-0.04) > 1e-9 || math.Abs(e.RequestFee-0.0001) > 1e-9 {
+		t.Errorf("fees = %f + %f, expected 0.04 + 0.0001", e.RetrievalFee, e.RequestFee)
+	}
+	if e.MinHours != 3 || e.MaxHours != 5 || len(e.Notes) != 0 {
+		t.Errorf("unlimited retrieval takes %f-%f hours (%v), expected 3-5", e.MinHours, e.MaxHours, e.Notes)
+	}
+
+	// 4GiB at 1GiB an hour has to be spread over 4 hours
+	e = estimateRetrieval(sizes, "Standard", "USD", p, retrievalLimits{Strategy: "BytesPerHour", BytesPerHour: 1 << 30})
+	if e.MinHours != 4 || e.MaxHours != 9 || len(e.Notes) != 1 {
+		t.Errorf("rate limited retrieval takes %f-%f hours (%v), expected 4-9", e.MinHours, e.MaxHours, e.Notes)
+	}
+
+	e = estimateRetrieval(sizes, "Expedited", "USD", p, retrievalLimits{Strategy: "BytesPerHour", BytesPerHour: 1 << 30})
+	if e.MinHours != 3 || len(e.Notes) != 2 {
+		t.Errorf("expedited retrieval shouldn't be held to the retrieval policy, got %f hours (%v)", e.MinHours, e.Notes)
+	}
+
+	if s := formatHours(0.0833); s != "5m" {
+		t.Errorf("formatHours(0.0833) = %s, expected 5m", s)
+	}
+	if s := formatHours(3.5); s != "3h30m" {
+		t.Errorf("formatHours(3.5) = %s, expected 3h30m", s)
+	}
+}
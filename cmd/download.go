@@ -0,0 +1,340 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+// downloadChunkSize is a power of two number of MiB, so every chunk lines up
+// with the tree hash and Glacier sends a checksum for it.
+const downloadChunkSize = int64(32 << 20)
+
+// download records the chunks of a job's output that have been written to disk
+// so that it can be resumed after the process dies.
+type download struct {
+	JobID       string `json:"job_id"`
+	Vault       string `json:"vault"`
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	ChunkSize   int64  `json:"chunk_size"`
+	Description string `json:"description"`
+	// tree hash of every chunk that has been written, keyed by its first byte
+	Chunks map[int64]string `json:"chunks"`
+
+	mu   sync.Mutex
+	file string
+}
+
+// downloadFile is unique to a vault, job and the absolute path being written.
+func downloadFile(jobID string, fp string) (string, error) {
+	dir, err := glacierDir()
+	if err != nil {
+		return "", err
+	}
+
+	abs, err := filepath.Abs(fp)
+	if err != nil {
+		return "", err
+	}
+
+	key := sha256.Sum256([]byte(vault + "\x00" + jobID + "\x00" + abs))
+	return filepath.Join(dir, "downloads", fmt.Sprintf("%x.json", key[:8])), nil
+}
+
+// loadDownload returns nil if there is no journal at the given location.
+func loadDownload(file string) (*download, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d := &download{file: file}
+	if err := json.Unmarshal(b, d); err != nil {
+		return nil, fmt.Errorf("corrupt download journal %s | %s", file, err)
+	}
+	if d.Chunks == nil {
+		d.Chunks = make(map[int64]string)
+	}
+	return d, nil
+}
+
+// done records a chunk as written, along with the archive description Glacier
+// sent with it.
+func (d *download) done(start int64, hash string, desc string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Chunks[start] = hash
+	if desc != "" {
+		d.Description = desc
+	}
+	return d.write()
+}
+
+func (d *download) write() error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.file, b)
+}
+
+func (d *download) remove() error {
+	err := os.Remove(d.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// jobOutputSize is the number of bytes a finished job will send back, or -1 if
+// Glacier doesn't say.
+func jobOutputSize(job *glacier.JobDescription) int64 {
+	switch aws.StringValue(job.Action) {
+	case glacier.ActionCodeArchiveRetrieval:
+		if r, err := parseByteRange(aws.StringValue(job.RetrievalByteRange)); err == nil {
+			return r.end - r.start + 1
+		}
+		if job.ArchiveSizeInBytes != nil {
+			return *job.ArchiveSizeInBytes
+		}
+	case glacier.ActionCodeInventoryRetrieval:
+		if job.InventorySizeInBytes != nil {
+			return *job.InventorySizeInBytes
+		}
+	}
+	return -1
+}
+
+// downloadJobOutput writes a finished job's output to a file and returns the
+// archive's description. Outputs of a known size are fetched in ranged chunks
+// at once, each checked against its tree hash and journaled so an interrupted
+// download picks up where it stopped. The whole file is then checked against
+// the job's tree hash when it has one.
+func downloadJobOutput(svc *glacier.Glacier, job *glacier.JobDescription, fp string) (string, error) {
+	jobID := aws.StringValue(job.JobId)
+	size := jobOutputSize(job)
+	if size <= 0 {
+		return streamJobOutput(svc, jobID, fp)
+	}
+
+	file, err := downloadFile(jobID, fp)
+	if err != nil {
+		return "", err
+	}
+
+	d, err := loadDownload(file)
+	if err != nil {
+		return "", err
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	if _, err := os.Stat(fp); d == nil || d.Size != size || d.ChunkSize != downloadChunkSize || err != nil {
+		d = &download{
+			JobID:     jobID,
+			Vault:     vault,
+			Path:      fp,
+			Size:      size,
+			ChunkSize: downloadChunkSize,
+			Chunks:    make(map[int64]string),
+			file:      file,
+		}
+		flags |= os.O_TRUNC
+	} else {
+		fmt.Printf("Resuming download of job %s (%d of %d chunk(s) done)\n", jobID, len(d.Chunks), (size+downloadChunkSize-1)/downloadChunkSize)
+	}
+
+	f, err := os.OpenFile(fp, flags, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// sparse until every chunk has been written
+	if err := f.Truncate(size); err != nil {
+		return "", err
+	}
+
+	var remaining []int64
+	for start := int64(0); start < size; start += downloadChunkSize {
+		if _, ok := d.Chunks[start]; !ok {
+			remaining = append(remaining, start)
+		}
+	}
+
+	p := newProgress(1, 0)
+	bar := p.newBar(filepath.Base(fp), size)
+	written := size
+	for _, start := range remaining {
+		written -= d.chunkEnd(start) - start
+	}
+	bar.Add64(written)
+
+	err = d.fetch(svc, f, remaining, bar)
+	bar.Finish()
+	p.stop()
+	if err != nil {
+		return "", fmt.Errorf("%s | run again to continue the download", err)
+	}
+
+	if expected := aws.StringValue(job.SHA256TreeHash); expected != "" {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		if actual := fmt.Sprintf("%x", glacier.ComputeHashes(f).TreeHash); actual != expected {
+			// the chunks on disk can't be trusted, start over next time
+			d.remove()
+			return "", fmt.Errorf("%s doesn't match the job's tree hash (%s != %s)", fp, actual, expected)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return d.Description, d.remove()
+}
+
+// chunkEnd is one past the last byte of the chunk starting at start.
+func (d *download) chunkEnd(start int64) int64 {
+	if end := start + d.ChunkSize; end < d.Size {
+		return end
+	}
+	return d.Size
+}
+
+// fetch downloads the chunks starting at the given offsets into f, as many at
+// once as the request budget allows.
+func (d *download) fetch(svc *glacier.Glacier, f *os.File, starts []int64, bar *progressBar) error {
+	var (
+		once     sync.Once
+		fetchErr error
+		wg       sync.WaitGroup
+	)
+	abort := make(chan struct{})
+	fail := func(err error) {
+		once.Do(func() {
+			fetchErr = err
+			close(abort)
+		})
+	}
+
+	for _, start := range starts {
+		if !budget.acquire(abort) {
+			break
+		}
+
+		wg.Add(1)
+		go func(start int64) {
+			defer wg.Done()
+			defer budget.release()
+
+			n, err := d.fetchChunk(svc, f, start)
+			if err != nil {
+				fail(err)
+				return
+			}
+			bar.Add64(n)
+		}(start)
+	}
+
+	wg.Wait()
+	return fetchErr
+}
+
+// fetchChunk downloads one chunk, checks it and writes it to its place in f.
+func (d *download) fetchChunk(svc *glacier.Glacier, f *os.File, start int64) (int64, error) {
+	end := d.chunkEnd(start)
+	byteRange := fmt.Sprintf("bytes=%d-%d", start, end-1)
+
+	var (
+		buf  []byte
+		hash string
+		desc string
+	)
+	err := withRetries(maxAttempts, func() error {
+		output, err := svc.GetJobOutputWithContext(aws.BackgroundContext(), &glacier.GetJobOutputInput{
+			AccountId: aws.String("-"),
+			JobId:     aws.String(d.JobID),
+			Range:     aws.String(byteRange),
+			VaultName: aws.String(vault),
+		}, noSDKRetries)
+		if err != nil {
+			return err
+		}
+		defer output.Body.Close()
+
+		// a connection that drops or mangles the chunk is worth another try
+		buf, err = ioutil.ReadAll(output.Body)
+		if err != nil {
+			return awserr.New(errCodeRequestError, "reading job output", err)
+		}
+		if int64(len(buf)) != end-start {
+			return awserr.New(errCodeRequestError, fmt.Sprintf("got %d bytes of %s", len(buf), byteRange), nil)
+		}
+
+		hash = fmt.Sprintf("%x", glacier.ComputeHashes(bytes.NewReader(buf)).TreeHash)
+		if expected := aws.StringValue(output.Checksum); expected != "" && hash != expected {
+			return awserr.New(errCodeRequestError, fmt.Sprintf("%s doesn't match its tree hash (%s != %s)", byteRange, hash, expected), nil)
+		}
+
+		desc = aws.StringValue(output.ArchiveDescription)
+		return nil
+	})
+	if err != nil {
+		return 0, formatAWSError(err)
+	}
+
+	if _, err := f.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+	// the journal can't claim a chunk that a crash would lose
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return int64(len(buf)), d.done(start, hash, desc)
+}
+
+// streamJobOutput writes a job's output to a file in one request, checking it
+// against the tree hash Glacier sends with it when there is one.
+func streamJobOutput(svc *glacier.Glacier, jobID string, fp string) (string, error) {
+	output, err := jobOutput(svc, jobID, "")
+	if err != nil {
+		return "", err
+	}
+	defer output.Body.Close()
+
+	f, err := os.OpenFile(fp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, output.Body); err != nil {
+		return "", err
+	}
+
+	if expected := aws.StringValue(output.Checksum); expected != "" {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		if actual := fmt.Sprintf("%x", glacier.ComputeHashes(f).TreeHash); actual != expected {
+			return "", fmt.Errorf("%s doesn't match the job's tree hash (%s != %s)", fp, actual, expected)
+		}
+	}
+
+	return aws.StringValue(output.ArchiveDescription), f.Close()
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+func TestJobOutputSize(t *testing.T) {
+	tests := []struct {
+		job      *glacier.JobDescription
+		expected int64
+	}{
+		{&glacier.JobDescription{Action: aws.String(glacier.ActionCodeArchiveRetrieval), ArchiveSizeInBytes: aws.Int64(100)}, 100},
+		{&glacier.JobDescription{Action: aws.String(glacier.ActionCodeArchiveRetrieval), ArchiveSizeInBytes: aws.Int64(100 << 20), RetrievalByteRange: aws.String("1048576-3145727")}, 2 << 20},
+		{&glacier.JobDescription{Action: aws.String(glacier.ActionCodeInventoryRetrieval), InventorySizeInBytes: aws.Int64(42)}, 42},
+		{&glacier.JobDescription{Action: aws.String(glacier.ActionCodeSelect)}, -1},
+	}
+
+	for _, test := range tests {
+		if got := jobOutputSize(test.job); got != test.expected {
+			t.Errorf("jobOutputSize(%s) = %d, expected %d", test.job, got, test.expected)
+		}
+	}
+}
+
+func TestFetchChunkRetriesCutOffBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glacier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldVault, oldAttempts := vault, maxAttempts
+	defer func() { vault, maxAttempts = oldVault, oldAttempts }()
+	vault, maxAttempts = "photos", 3
+
+	data := bytes.Repeat([]byte("x"), 1000)
+	var requests int
+	svc, closeServer := testGlacier(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.WriteHeader(http.StatusOK)
+		if requests == 1 {
+			// the connection drops halfway through the body
+			w.Write(data[:len(data)/2])
+			return
+		}
+		w.Write(data)
+	}))
+	defer closeServer()
+
+	f, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	d := &download{
+		JobID:     "job",
+		Size:      int64(len(data)),
+		ChunkSize: downloadChunkSize,
+		Chunks:    make(map[int64]string),
+		file:      filepath.Join(dir, "journal.json"),
+	}
+	n, err := d.fetchChunk(svc, f, 0)
+	if err != nil {
+		t.Fatalf("fetchChunk failed | %s", err)
+	}
+	if n != int64(len(data)) || requests != 2 {
+		t.Errorf("fetchChunk = %d bytes in %d request(s), expected %d in 2", n, requests, len(data))
+	}
+}
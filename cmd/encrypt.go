@@ -0,0 +1,355 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+	"gopkg.in/cheggaaa/pb.v2/termutil"
+)
+
+// Encrypted archives are a header followed by AES-256-GCM sealed chunks. Each
+// chunk's nonce is its index plus a flag marking the last chunk, so chunks
+// can't be reordered, dropped or truncated without decryption failing.
+const (
+	encryptionName    = "aes-256-gcm"
+	encryptionMagic   = "GLCE"
+	encryptionVersion = 1
+	encryptionChunk   = 64 << 10
+	pbkdf2Iterations  = 600000
+	passphraseEnv     = "GLACIER_PASSPHRASE"
+
+	// headers asking for more are corrupt, not just cautious
+	maxPBKDF2Iterations = 10 * pbkdf2Iterations
+)
+
+// how the archive key is derived
+const (
+	kdfHKDF   byte = iota // from a key file
+	kdfPBKDF2             // from a passphrase
+	kdfNone               // used as is, e.g. a KMS data key
+)
+
+// encryptionHeader starts every encrypted archive.
+type encryptionHeader struct {
+	Version    byte
+	KDF        byte
+	Iterations uint32
+	Salt       [32]byte
+	ChunkSize  uint32
+}
+
+func (h encryptionHeader) bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(encryptionMagic)
+	binary.Write(&buf, binary.BigEndian, h)
+	return buf.Bytes()
+}
+
+func readEncryptionHeader(r io.Reader) (encryptionHeader, error) {
+	var h encryptionHeader
+
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != encryptionMagic {
+		return h, fmt.Errorf("archive is not encrypted by glacier")
+	}
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return h, fmt.Errorf("truncated encryption header | %s", err)
+	}
+	if h.Version != encryptionVersion {
+		return h, fmt.Errorf("unsupported encryption version %d", h.Version)
+	}
+	if h.ChunkSize == 0 || h.ChunkSize > 64<<20 {
+		return h, fmt.Errorf("invalid encryption chunk size %d", h.ChunkSize)
+	}
+	if h.KDF == kdfPBKDF2 && (h.Iterations < pbkdf2Iterations || h.Iterations > maxPBKDF2Iterations) {
+		return h, fmt.Errorf("invalid PBKDF2 iteration count %d (expected %d to %d)", h.Iterations, pbkdf2Iterations, maxPBKDF2Iterations)
+	}
+	return h, nil
+}
+
+// keySource holds either a key file's key or a passphrase, from which a
+// different key is derived for every archive.
+type keySource struct {
+	secret     []byte
+	passphrase bool
+}
+
+// loadKeySource reads the key file if one was given, otherwise the passphrase
+// from a file, $GLACIER_PASSPHRASE or the terminal.
+func loadKeySource(keyFile string, passphraseFile string, confirm bool) (*keySource, error) {
+	if keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		// either 32 raw bytes or 64 hex characters
+		if len(b) != 32 {
+			b, err = hex.DecodeString(strings.TrimSpace(string(b)))
+			if err != nil || len(b) != 32 {
+				return nil, fmt.Errorf("invalid key file %s: expected 32 bytes of raw or hex encoded key", keyFile)
+			}
+		}
+		return &keySource{secret: b}, nil
+	}
+
+	if passphraseFile != "" {
+		b, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return newPassphrase(strings.TrimRight(string(b), "\r\n"))
+	}
+
+	if p := os.Getenv(passphraseEnv); p != "" {
+		return newPassphrase(p)
+	}
+
+	p, err := promptPassphrase("Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		again, err := promptPassphrase("Confirm passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if again != p {
+			return nil, fmt.Errorf("passphrases don't match")
+		}
+	}
+	return newPassphrase(p)
+}
+
+func newPassphrase(p string) (*keySource, error) {
+	if p == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	return &keySource{secret: []byte(p), passphrase: true}, nil
+}
+
+// promptPassphrase reads a line from the terminal without echoing it. stdin
+// isn't used since it may be the data being uploaded.
+func promptPassphrase(prompt string) (string, error) {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return "", fmt.Errorf("no terminal to read a passphrase from, use --passphrase-file or $%s", passphraseEnv)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(os.Stderr, prompt)
+	quit, err := termutil.RawModeOn()
+	if err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	quit <- struct{}{}
+	termutil.RawModeOff()
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// newHeader salts a header for a new archive.
+func (k *keySource) newHeader() (encryptionHeader, error) {
+	h := encryptionHeader{
+		Version:   encryptionVersion,
+		KDF:       kdfHKDF,
+		ChunkSize: encryptionChunk,
+	}
+	if k.passphrase {
+		h.KDF = kdfPBKDF2
+		h.Iterations = pbkdf2Iterations
+	}
+	_, err := rand.Read(h.Salt[:])
+	return h, err
+}
+
+// archiveKey derives the key of the archive with the given header.
+func (k *keySource) archiveKey(h encryptionHeader) ([]byte, error) {
+	switch h.KDF {
+	case kdfHKDF:
+		if k.passphrase {
+			return nil, fmt.Errorf("archive was encrypted with a key file, not a passphrase")
+		}
+		key := make([]byte, 32)
+		_, err := io.ReadFull(hkdf.New(sha256.New, k.secret, h.Salt[:], []byte("glacier archive")), key)
+		return key, err
+	case kdfPBKDF2:
+		if !k.passphrase {
+			return nil, fmt.Errorf("archive was encrypted with a passphrase, not a key file")
+		}
+		return pbkdf2.Key(k.secret, h.Salt[:], int(h.Iterations), 32, sha256.New), nil
+	default:
+		return nil, fmt.Errorf("unsupported key derivation %d", h.KDF)
+	}
+}
+
+// chunkNonce is the chunk's index followed by whether it's the last one.
+func chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptStream returns r encrypted under key, encrypted on the fly as it's
+// read. Closing the reader stops the encryption.
+func encryptStream(r io.Reader, key []byte, h encryptionHeader) (*io.PipeReader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		header := h.bytes()
+		if _, err := pw.Write(header); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		// read one byte past the chunk to know whether it's the last one
+		buf := make([]byte, h.ChunkSize+1)
+		n, err := io.ReadFull(r, buf)
+		for index := uint64(0); ; index++ {
+			last := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !last {
+				pw.CloseWithError(err)
+				return
+			}
+
+			chunk := buf[:n]
+			if !last {
+				chunk = buf[:h.ChunkSize]
+			}
+			if _, err := pw.Write(aead.Seal(nil, chunkNonce(index, last), chunk, header)); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if last {
+				pw.Close()
+				return
+			}
+
+			// carry over the extra byte
+			buf[0] = buf[h.ChunkSize]
+			n, err = io.ReadFull(r, buf[1:])
+			n++
+		}
+	}()
+	return pr, nil
+}
+
+// newKMSHeader is the header of an archive encrypted with a KMS data key.
+func newKMSHeader() encryptionHeader {
+	return encryptionHeader{
+		Version:   encryptionVersion,
+		KDF:       kdfNone,
+		ChunkSize: encryptionChunk,
+	}
+}
+
+// decryptStream reads the header off an encrypted archive and returns the
+// decrypted contents. Reads fail if the archive was tampered with.
+func decryptStream(r io.Reader, archiveKey func(encryptionHeader) ([]byte, error)) (io.Reader, error) {
+	h, err := readEncryptionHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := archiveKey(h)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		header: h.bytes(),
+		buf:    make([]byte, int(h.ChunkSize)+aead.Overhead()),
+	}, nil
+}
+
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	index  uint64
+	plain  []byte
+	done   bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk. A chunk is the last one if nothing follows it.
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.buf)
+	if err == io.EOF {
+		return fmt.Errorf("encrypted archive is truncated")
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+
+	plain, err := d.aead.Open(d.buf[:0], chunkNonce(d.index, last), d.buf[:n], d.header)
+	if err != nil {
+		return fmt.Errorf("encrypted archive is corrupt or the key is wrong | chunk %d", d.index)
+	}
+
+	d.plain = plain
+	d.index++
+	d.done = last
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncryptRoundTrip(t *testing.T) {
+	k := &keySource{secret: make([]byte, 32)}
+
+	for _, size := range []int{0, 1, encryptionChunk - 1, encryptionChunk, encryptionChunk + 1, 3*encryptionChunk + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		encrypted := encryptBytes(t, k, plain)
+
+		r, err := decryptStream(bytes.NewReader(encrypted), k.archiveKey)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		if !bytes.Equal(plain, decrypted) {
+			t.Errorf("%d bytes: decrypted data doesn't match", size)
+		}
+	}
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	k := &keySource{secret: make([]byte, 32)}
+	plain := make([]byte, 2*encryptionChunk+10)
+	encrypted := encryptBytes(t, k, plain)
+
+	overhead := encryptionChunk + 16
+	headerSize := len(encrypted) - 2*overhead - (10 + 16)
+
+	tests := map[string][]byte{
+		"truncated at a chunk": encrypted[:headerSize+overhead],
+		"truncated mid chunk":  encrypted[:len(encrypted)-1],
+		"flipped bit":          append(append([]byte{}, encrypted[:headerSize+5]...), append([]byte{encrypted[headerSize+5] ^ 1}, encrypted[headerSize+6:]...)...),
+	}
+
+	for name, data := range tests {
+		r, err := decryptStream(bytes.NewReader(data), k.archiveKey)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Errorf("%s: expected decryption to fail", name)
+		}
+	}
+
+	wrong := &keySource{secret: bytes.Repeat([]byte{1}, 32)}
+	r, err := decryptStream(bytes.NewReader(encrypted), wrong.archiveKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Errorf("expected decryption with the wrong key to fail")
+	}
+}
+
+func encryptBytes(t *testing.T, k *keySource, plain []byte) []byte {
+	h, err := k.newHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := k.archiveKey(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := encryptStream(bytes.NewReader(plain), key, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
+
+func TestReadEncryptionHeaderIterations(t *testing.T) {
+	tests := []struct {
+		iterations uint32
+		fails      bool
+	}{
+		{iterations: pbkdf2Iterations},
+		{iterations: maxPBKDF2Iterations},
+		{iterations: 0, fails: true},
+		{iterations: 1000, fails: true},
+		{iterations: maxPBKDF2Iterations + 1, fails: true},
+		{iterations: 1<<32 - 1, fails: true},
+	}
+
+	for _, test := range tests {
+		h := encryptionHeader{Version: encryptionVersion, KDF: kdfPBKDF2, Iterations: test.iterations, ChunkSize: encryptionChunk}
+		_, err := readEncryptionHeader(bytes.NewReader(h.bytes()))
+		if test.fails && err == nil {
+			t.Errorf("readEncryptionHeader with %d iterations should have failed", test.iterations)
+		}
+		if !test.fails && err != nil {
+			t.Errorf("readEncryptionHeader with %d iterations failed | %s", test.iterations, err)
+		}
+	}
+}
@@ -1,56 +1,354 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/glacier"
 	"github.com/spf13/cobra"
 )
 
-var sns string
+var (
+	sns                string
+	inventoryJob       string
+	inventoryFormat    string
+	inventoryStartDate string
+	inventoryEndDate   string
+	inventoryLimit     int
+	inventoryMarker    string
+	wait               bool
+	waitInterval       time.Duration
+	waitTimeout        time.Duration
+)
 
 var inventoryCmd = &cobra.Command{
 	Use:   "inventory",
 	Short: "Trigger a vault inventory",
-	Long:  `The inventory will be published to the given SNS.`,
+	Long: `The inventory will be published to the given SNS, if any. With --wait, the
+inventory is downloaded once it's ready and saved as the vault's snapshot for
+the list command. Inventories usually take around four hours.
+
+Large vaults can be inventoried in slices with --limit; while waiting, a new
+job is started for the next slice whenever one comes back truncated. Slices
+filtered by date or started from a --marker are merged into the existing
+snapshot instead of replacing it.
+
+With --vault-tag instead of --vault, every vault with the given tags is
+inventoried.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return initiateJob()
+		format := strings.ToUpper(inventoryFormat)
+		if format != "CSV" && format != "JSON" {
+			return fmt.Errorf("invalid format: %s", inventoryFormat)
+		}
+
+		if waitInterval <= 0 {
+			return fmt.Errorf("invalid interval: must be more than 0")
+		}
+
+		vaults, err := selectedVaults()
+		if err != nil {
+			return err
+		}
+		if inventoryJob != "" && len(vaults) > 1 {
+			return fmt.Errorf("--job-id can only be used with a single vault")
+		}
+
+		// start every job before waiting on any of them
+		jobIDs := make([]string, len(vaults))
+		for i, v := range vaults {
+			vault = v
+			jobIDs[i] = inventoryJob
+			if jobIDs[i] == "" {
+				params, err := inventoryParameters()
+				if err != nil {
+					return err
+				}
+				if jobIDs[i], err = initiateJob(format, params); err != nil {
+					return err
+				}
+			}
+		}
+
+		if !wait {
+			return nil
+		}
+
+		if len(vaults) == 1 {
+			return collectInventory(format, jobIDs[0])
+		}
+
+		var failed int
+		for i, v := range vaults {
+			vault = v
+			if err := collectInventory(format, jobIDs[i]); err != nil {
+				fmt.Printf("%s failed | %s\n", v, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d vault(s) failed to inventory", failed, len(vaults))
+		}
+		return nil
 	},
 }
 
 func init() {
 	inventoryCmd.Flags().StringVarP(&sns, "sns", "s", "", "SNS topic to publish to")
-	err := inventoryCmd.MarkFlagRequired("sns")
-	if err != nil {
-		log.Fatal(err)
-	}
 
 	inventoryCmd.Flags().StringVarP(&vault, "vault", "v", "", "Vault name")
-	err = inventoryCmd.MarkFlagRequired("vault")
+	inventoryCmd.Flags().StringSliceVar(&vaultTags, "vault-tag", nil, "Inventory every vault with this tag, as key=value, instead of --vault (can be repeated, all have to match)")
+
+	inventoryCmd.Flags().StringVar(&inventoryFormat, "format", "csv", "Inventory format (json, csv)")
+	inventoryCmd.Flags().StringVar(&inventoryStartDate, "start-date", "", "Only archives created on or after this date (YYYY-MM-DD or RFC 3339)")
+	inventoryCmd.Flags().StringVar(&inventoryEndDate, "end-date", "", "Only archives created before this date (YYYY-MM-DD or RFC 3339)")
+	inventoryCmd.Flags().IntVar(&inventoryLimit, "limit", 0, "Maximum number of archives per inventory job (0 for no limit)")
+	inventoryCmd.Flags().StringVar(&inventoryMarker, "marker", "", "Marker to start the inventory from, as returned by a truncated inventory job")
+	inventoryCmd.Flags().StringVar(&inventoryJob, "job-id", "", "Use an inventory job that's already been started instead of starting one")
+	inventoryCmd.Flags().BoolVarP(&wait, "wait", "w", false, "Wait for the inventory and download it")
+	inventoryCmd.Flags().DurationVar(&waitInterval, "interval", 15*time.Minute, "How often to check on the job while waiting")
+	inventoryCmd.Flags().DurationVar(&waitTimeout, "timeout", 24*time.Hour, "How long to wait before giving up (0 waits forever)")
+	inventoryCmd.Flags().IntVar(&maxAttempts, "max-attempts", 5, "Maximum number of times to try each request")
+}
+
+// collectInventory waits for the vault's inventory job, following it up with
+// more jobs while the inventory comes back truncated, and saves the result as
+// the vault's snapshot.
+func collectInventory(format string, jobID string) error {
+	params, err := inventoryParameters()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	var snap *inventorySnapshot
+	for {
+		job, err := waitForJob(svc, jobID, waitInterval, waitTimeout)
+		if err != nil {
+			return err
+		}
+
+		slice, err := downloadInventory(svc, job)
+		if err != nil {
+			return err
+		}
+		if snap == nil {
+			snap = slice
+		} else {
+			snap.Archives = append(snap.Archives, slice.Archives...)
+		}
+
+		// a marker means the inventory stopped at the limit
+		if job.InventoryRetrievalParameters == nil || aws.StringValue(job.InventoryRetrievalParameters.Marker) == "" {
+			break
+		}
+
+		params.Marker = job.InventoryRetrievalParameters.Marker
+		fmt.Printf("Inventory was truncated after %d archive(s), starting a job for the next slice\n", len(snap.Archives))
+		jobID, err = initiateJob(format, params)
+		if err != nil {
+			return err
+		}
+	}
+
+	if inventoryStartDate != "" || inventoryEndDate != "" || inventoryMarker != "" {
+		if snap, err = mergeSnapshot(snap); err != nil {
+			return err
+		}
+	}
+	if err := saveSnapshot(snap); err != nil {
+		return err
 	}
+
+	fmt.Printf("Saved inventory of %d archive(s) of %s from %s\n", len(snap.Archives), snap.Vault, snap.InventoryDate.Format(time.RFC3339))
+	return nil
 }
 
-func initiateJob() error {
+// inventoryParameters builds the inventory's filters from the flags.
+func inventoryParameters() (*glacier.InventoryRetrievalJobInput, error) {
+	params := &glacier.InventoryRetrievalJobInput{}
+	if inventoryStartDate != "" {
+		t, err := parseDate(inventoryStartDate)
+		if err != nil {
+			return nil, err
+		}
+		params.StartDate = aws.String(t.UTC().Format(time.RFC3339))
+	}
+	if inventoryEndDate != "" {
+		t, err := parseDate(inventoryEndDate)
+		if err != nil {
+			return nil, err
+		}
+		params.EndDate = aws.String(t.UTC().Format(time.RFC3339))
+	}
+	if inventoryLimit < 0 {
+		return nil, fmt.Errorf("invalid limit: %d", inventoryLimit)
+	}
+	if inventoryLimit > 0 {
+		params.Limit = aws.String(strconv.Itoa(inventoryLimit))
+	}
+	if inventoryMarker != "" {
+		params.Marker = aws.String(inventoryMarker)
+	}
+	return params, nil
+}
+
+func initiateJob(format string, params *glacier.InventoryRetrievalJobInput) (string, error) {
+	jobParams := &glacier.JobParameters{
+		Description: aws.String("glacier inventory"),
+		Format:      aws.String(format),
+		Type:        aws.String("inventory-retrieval"),
+	}
+	if *params != (glacier.InventoryRetrievalJobInput{}) {
+		jobParams.InventoryRetrievalParameters = params
+	}
+	if sns != "" {
+		jobParams.SNSTopic = aws.String(sns)
+	}
+
 	input := &glacier.InitiateJobInput{
-		AccountId: aws.String("-"),
-		JobParameters: &glacier.JobParameters{
-			Description: aws.String("My inventory job"),
-			Format:      aws.String("CSV"),
-			SNSTopic:    aws.String(sns),
-			Type:        aws.String("inventory-retrieval"),
-		},
-		VaultName: aws.String(vault),
+		AccountId:     aws.String("-"),
+		JobParameters: jobParams,
+		VaultName:     aws.String(vault),
 	}
 
 	result, err := svc.InitiateJob(input)
 	if err != nil {
-		return formatAWSError(err)
+		return "", formatAWSError(err)
 	}
 
 	fmt.Println(result)
-	return nil
+	return *result.JobId, nil
+}
+
+// mergeSnapshot adds a partial inventory to the vault's existing snapshot,
+// keeping the newer details of archives that appear in both.
+func mergeSnapshot(slice *inventorySnapshot) (*inventorySnapshot, error) {
+	existing, err := loadSnapshot(slice.Region, slice.Vault)
+	if err != nil || existing == nil {
+		return slice, err
+	}
+
+	seen := make(map[string]bool, len(slice.Archives))
+	for _, a := range slice.Archives {
+		seen[a.ArchiveID] = true
+	}
+	for _, a := range existing.Archives {
+		if !seen[a.ArchiveID] {
+			slice.Archives = append(slice.Archives, a)
+		}
+	}
+	return slice, nil
+}
+
+// downloadInventory fetches and parses the output of a finished inventory job.
+func downloadInventory(svc *glacier.Glacier, job *glacier.JobDescription) (*inventorySnapshot, error) {
+	output, err := jobOutput(svc, aws.StringValue(job.JobId), "")
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	b, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	format := "CSV"
+	if job.InventoryRetrievalParameters != nil {
+		format = aws.StringValue(job.InventoryRetrievalParameters.Format)
+	}
+
+	snap, err := parseInventory(bytes.NewReader(b), format)
+	if err != nil {
+		return nil, err
+	}
+
+	// CSV inventories don't say when they were taken
+	if snap.InventoryDate.IsZero() {
+		snap.InventoryDate, _ = time.Parse(time.RFC3339, aws.StringValue(job.CompletionDate))
+	}
+	snap.Vault = vault
+	snap.Region = region
+	snap.RetrievedAt = time.Now().UTC()
+	return snap, nil
+}
+
+// jsonInventory is the format of JSON inventory job output.
+type jsonInventory struct {
+	VaultARN      string
+	InventoryDate time.Time
+	ArchiveList   []struct {
+		ArchiveId          string
+		ArchiveDescription string
+		CreationDate       time.Time
+		Size               int64
+		SHA256TreeHash     string
+	}
+}
+
+// parseInventory reads inventory job output in either format.
+func parseInventory(r io.Reader, format string) (*inventorySnapshot, error) {
+	snap := &inventorySnapshot{}
+
+	switch strings.ToUpper(format) {
+	case "JSON":
+		var inv jsonInventory
+		if err := json.NewDecoder(r).Decode(&inv); err != nil {
+			return nil, fmt.Errorf("invalid JSON inventory | %s", err)
+		}
+
+		snap.InventoryDate = inv.InventoryDate
+		for _, a := range inv.ArchiveList {
+			snap.Archives = append(snap.Archives, inventoryArchive{
+				ArchiveID:    a.ArchiveId,
+				Description:  a.ArchiveDescription,
+				CreationDate: a.CreationDate,
+				Size:         a.Size,
+				TreeHash:     a.SHA256TreeHash,
+			})
+		}
+	case "CSV":
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV inventory | %s", err)
+		}
+
+		// ArchiveId,ArchiveDescription,CreationDate,Size,SHA256TreeHash
+		for i, rec := range records {
+			if i == 0 && len(rec) > 0 && rec[0] == "ArchiveId" {
+				continue
+			}
+			if len(rec) != 5 {
+				return nil, fmt.Errorf("invalid CSV inventory | line %d has %d fields", i+1, len(rec))
+			}
+
+			created, err := time.Parse(time.RFC3339, rec[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid CSV inventory | line %d | %s", i+1, err)
+			}
+			size, err := strconv.ParseInt(rec[3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CSV inventory | line %d | %s", i+1, err)
+			}
+
+			snap.Archives = append(snap.Archives, inventoryArchive{
+				ArchiveID:    rec[0],
+				Description:  rec[1],
+				CreationDate: created,
+				Size:         size,
+				TreeHash:     rec[4],
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported inventory format: %s", format)
+	}
+
+	return snap, nil
 }
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseInventory(t *testing.T) {
+	jsonOutput := `{"VaultARN":"arn:aws:glacier:us-east-1:012345678901:vaults/examplevault",
+"InventoryDate":"2011-12-12T14:19:01Z",
+"ArchiveList":[
+{"ArchiveId":"DMTmICA2n5Tdqq5BV2z7og","ArchiveDescription":"a.txt","CreationDate":"2011-12-12T06:07:39Z","Size":1024,"SHA256TreeHash":"beb0fe31a1c7ca8c6c04d574ea906e3f97b31fdca7571defb5b44dca89b5af60"},
+{"ArchiveId":"2ydUwyBA4wYXZGbMU7uvBg","ArchiveDescription":"{\"name\":\"b.log\",\"compress\":\"gzip\"}","CreationDate":"2011-12-12T06:07:40Z","Size":2048,"SHA256TreeHash":"7f2fe580edb35154041fa3d4b41dd6d3e474e0a9b8e4b3b4f5c1b5c0e8b1c1d2"}
+]}`
+
+	csvOutput := `ArchiveId,ArchiveDescription,CreationDate,Size,SHA256TreeHash
+DMTmICA2n5Tdqq5BV2z7og,a.txt,2011-12-12T06:07:39Z,1024,beb0fe31a1c7ca8c6c04d574ea906e3f97b31fdca7571defb5b44dca89b5af60
+2ydUwyBA4wYXZGbMU7uvBg,"{""name"":""b.log"",""compress"":""gzip""}",2011-12-12T06:07:40Z,2048,7f2fe580edb35154041fa3d4b41dd6d3e474e0a9b8e4b3b4f5c1b5c0e8b1c1d2
+`
+
+	for format, output := range map[string]string{"JSON": jsonOutput, "CSV": csvOutput} {
+		snap, err := parseInventory(strings.NewReader(output), format)
+		if err != nil {
+			t.Errorf("%s failed | %s", format, err)
+			continue
+		}
+
+		if len(snap.Archives) != 2 {
+			t.Errorf("%s: expected 2 archives, got %d", format, len(snap.Archives))
+			continue
+		}
+
+		a := snap.Archives[1]
+		if a.ArchiveID != "2ydUwyBA4wYXZGbMU7uvBg" || a.Size != 2048 || parseDescription(a.Description).Compress != "gzip" {
+			t.Errorf("%s: unexpected archive %+v", format, a)
+		}
+		if !a.CreationDate.Equal(time.Date(2011, 12, 12, 6, 7, 40, 0, time.UTC)) {
+			t.Errorf("%s: unexpected creation date %s", format, a.CreationDate)
+		}
+	}
+
+	if _, err := parseInventory(strings.NewReader("x,y\n"), "CSV"); err == nil {
+		t.Errorf("expected a malformed CSV inventory to fail")
+	}
+}
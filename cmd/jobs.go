@@ -0,0 +1,262 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/spf13/cobra"
+)
+
+var (
+	jobsCompleted bool
+	jobsStatus    string
+	jobsOutFile   string
+)
+
+var jobsCmd = &cobra.Command{
+	Use:   "jobs",
+	Short: "Keep track of a vault's inventory, retrieval and select jobs",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var jobsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List a vault's jobs",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		input := &glacier.ListJobsInput{
+			AccountId: aws.String("-"),
+			VaultName: aws.String(vault),
+		}
+		if cmd.Flags().Changed("completed") {
+			input.Completed = aws.String(fmt.Sprintf("%t", jobsCompleted))
+		}
+		if jobsStatus != "" {
+			input.Statuscode = aws.String(jobsStatus)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "JOB ID\tACTION\tSTATUS\tCREATED\tCOMPLETED\tDESCRIPTION")
+		err := svc.ListJobsPages(input, func(page *glacier.ListJobsOutput, lastPage bool) bool {
+			for _, job := range page.JobList {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+					aws.StringValue(job.JobId),
+					aws.StringValue(job.Action),
+					aws.StringValue(job.StatusCode),
+					aws.StringValue(job.CreationDate),
+					aws.StringValue(job.CompletionDate),
+					aws.StringValue(job.JobDescription),
+				)
+			}
+			return true
+		})
+		if err != nil {
+			return formatAWSError(err)
+		}
+		return w.Flush()
+	},
+}
+
+var jobsDescribeCmd = &cobra.Command{
+	Use:   "describe <job id>",
+	Short: "Show everything about a job",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		job, err := describeJob(svc, args[0])
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(job)
+		return nil
+	},
+}
+
+var jobsWaitCmd = &cobra.Command{
+	Use:   "wait <job id>",
+	Short: "Wait until a job is completed",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if waitInterval <= 0 {
+			return fmt.Errorf("invalid interval: must be more than 0")
+		}
+
+		job, err := waitForJob(svc, args[0], waitInterval, waitTimeout)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(job)
+		return nil
+	},
+}
+
+var jobsOutputCmd = &cobra.Command{
+	Use:   "output <job id>",
+	Short: "Download the output of a completed job",
+	Long: `Whole archives are decompressed and decrypted the same way retrieve does it.
+The output of a byte range retrieval is written as it was stored, since
+part of a compressed or encrypted archive can't be decoded on its own.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if concurrency < 1 {
+			return fmt.Errorf("invalid concurrency: must be at least 1")
+		}
+		budget = newRequestBudget(concurrency)
+
+		job, err := describeJob(svc, args[0])
+		if err != nil {
+			return err
+		}
+		if aws.StringValue(job.Action) == glacier.ActionCodeSelect && job.OutputLocation != nil && job.OutputLocation.S3 != nil {
+			return fmt.Errorf("select job %s writes its results to %s, not to a job output", args[0], selectResults(job.OutputLocation.S3, args[0]))
+		}
+
+		if aws.StringValue(job.Action) == glacier.ActionCodeArchiveRetrieval && wholeArchive(job) {
+			kmsSvc, err = newKMS(cmd)
+			if err != nil {
+				return err
+			}
+			return downloadArchive(svc, job, jobsOutFile, nil)
+		}
+
+		_, err = downloadJobOutput(svc, job, jobsOutFile)
+		return err
+	},
+}
+
+func init() {
+	jobsCmd.AddCommand(
+		jobsListCmd,
+		jobsDescribeCmd,
+		jobsWaitCmd,
+		jobsOutputCmd,
+	)
+
+	for _, c := range []*cobra.Command{jobsListCmd, jobsDescribeCmd, jobsWaitCmd, jobsOutputCmd} {
+		c.Flags().StringVarP(&vault, "vault", "v", "", "Vault name")
+		err := c.MarkFlagRequired("vault")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		c.Flags().IntVar(&maxAttempts, "max-attempts", 5, "Maximum number of times to try each request")
+	}
+
+	jobsListCmd.Flags().BoolVar(&jobsCompleted, "completed", false, "Only completed jobs (or with =false, only jobs still in progress)")
+	jobsListCmd.Flags().StringVar(&jobsStatus, "status", "", "Only jobs with this status (InProgress, Succeeded, Failed)")
+
+	jobsWaitCmd.Flags().DurationVar(&waitInterval, "interval", 15*time.Minute, "How often to check on the job")
+	jobsWaitCmd.Flags().DurationVar(&waitTimeout, "timeout", 24*time.Hour, "How long to wait before giving up (0 waits forever)")
+
+	jobsOutputCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 4, "Number of chunks to download at once")
+	jobsOutputCmd.Flags().StringVarP(&jobsOutFile, "output", "o", "", "File to write the output to")
+	jobsOutputCmd.Flags().StringVar(&keyFile, "key-file", "", "Key file the archive was encrypted with")
+	jobsOutputCmd.Flags().StringVar(&passphraseFile, "passphrase-file", "", "File holding the passphrase the archive was encrypted with (also read from $"+passphraseEnv+" or prompted for)")
+	err := jobsOutputCmd.MarkFlagRequired("output")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func describeJob(svc *glacier.Glacier, jobID string) (*glacier.JobDescription, error) {
+	job, err := lookupJob(svc, jobID)
+	if err != nil {
+		return nil, formatAWSError(err)
+	}
+	return job, nil
+}
+
+// lookupJob is describeJob without formatting the error, so callers can tell
+// with isNotFound whether the job has expired.
+func lookupJob(svc *glacier.Glacier, jobID string) (*glacier.JobDescription, error) {
+	var job *glacier.JobDescription
+	err := withRetries(maxAttempts, func() error {
+		var err error
+		job, err = svc.DescribeJobWithContext(aws.BackgroundContext(), &glacier.DescribeJobInput{
+			AccountId: aws.String("-"),
+			JobId:     aws.String(jobID),
+			VaultName: aws.String(vault),
+		}, noSDKRetries)
+		return err
+	})
+	return job, err
+}
+
+// isNotFound is true for errors about a job, vault or upload that doesn't
+// exist (or no longer does).
+func isNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == glacier.ErrCodeResourceNotFoundException
+}
+
+// waitForJob polls the job every interval until it's done. A timeout of 0
+// waits forever. Jobs that finish without succeeding are an error.
+func waitForJob(svc *glacier.Glacier, jobID string, interval time.Duration, timeout time.Duration) (*glacier.JobDescription, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		job, err := describeJob(svc, jobID)
+		if err != nil {
+			return nil, err
+		}
+
+		if aws.BoolValue(job.Completed) {
+			if aws.StringValue(job.StatusCode) != glacier.StatusCodeSucceeded {
+				return job, fmt.Errorf("job %s %s | %s", jobID, aws.StringValue(job.StatusCode), aws.StringValue(job.StatusMessage))
+			}
+			return job, nil
+		}
+
+		if !deadline.IsZero() && time.Now().Add(interval).After(deadline) {
+			return job, fmt.Errorf("job %s is still %s after %s", jobID, aws.StringValue(job.StatusCode), timeout)
+		}
+
+		fmt.Printf("Job %s is %s, checking again in %s\n", jobID, aws.StringValue(job.StatusCode), interval)
+		time.Sleep(interval)
+	}
+}
+
+// jobOutput starts downloading a finished job's output. byteRange is either
+// empty for all of it or "bytes=start-end".
+func jobOutput(svc *glacier.Glacier, jobID string, byteRange string) (*glacier.GetJobOutputOutput, error) {
+	input := &glacier.GetJobOutputInput{
+		AccountId: aws.String("-"),
+		JobId:     aws.String(jobID),
+		VaultName: aws.String(vault),
+	}
+	if byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+
+	var output *glacier.GetJobOutputOutput
+	err := withRetries(maxAttempts, func() error {
+		var err error
+		output, err = svc.GetJobOutputWithContext(aws.BackgroundContext(), input, noSDKRetries)
+		return err
+	})
+	if err != nil {
+		return nil, formatAWSError(err)
+	}
+	return output, nil
+}
+
+// wholeArchive is true if an archive retrieval job retrieved all of the
+// archive rather than a byte range of it.
+func wholeArchive(job *glacier.JobDescription) bool {
+	r, err := parseByteRange(aws.StringValue(job.RetrievalByteRange))
+	if err != nil {
+		return true
+	}
+	return r.start == 0 && (job.ArchiveSizeInBytes == nil || r.end == *job.ArchiveSizeInBytes-1)
+}
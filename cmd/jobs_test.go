@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+func TestWholeArchive(t *testing.T) {
+	tests := []struct {
+		job      *glacier.JobDescription
+		expected bool
+	}{
+		{&glacier.JobDescription{ArchiveSizeInBytes: aws.Int64(100)}, true},
+		{&glacier.JobDescription{ArchiveSizeInBytes: aws.Int64(100), RetrievalByteRange: aws.String("0-99")}, true},
+		{&glacier.JobDescription{ArchiveSizeInBytes: aws.Int64(100 << 20), RetrievalByteRange: aws.String("0-1048575")}, false},
+		{&glacier.JobDescription{ArchiveSizeInBytes: aws.Int64(100 << 20), RetrievalByteRange: aws.String("1048576-104857599")}, false},
+	}
+
+	for _, test := range tests {
+		if got := wholeArchive(test.job); got != test.expected {
+			t.Errorf("wholeArchive(%s) = %t, expected %t", test.job, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journal records the progress of a multipart upload so that it can be resumed
+// after the process dies.
+type journal struct {
+	UploadID    string    `json:"upload_id"`
+	Vault       string    `json:"vault"`
+	Description string    `json:"description"`
+	PartSize    int64     `json:"part_size"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	// tree hash of every part that has been uploaded, keyed by its first byte
+	Parts map[int64]string `json:"parts"`
+
+	mu   sync.Mutex
+	file string
+}
+
+// glacierDir is where local state (journals, the catalog, etc) is kept.
+func glacierDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".glacier"), nil
+}
+
+// journalFile is unique to a vault and the absolute path of the file going
+// into it.
+func journalFile(vault string, fp string) (string, error) {
+	dir, err := glacierDir()
+	if err != nil {
+		return "", err
+	}
+
+	abs, err := filepath.Abs(fp)
+	if err != nil {
+		return "", err
+	}
+
+	key := sha256.Sum256([]byte(vault + "\x00" + abs))
+	return filepath.Join(dir, "uploads", fmt.Sprintf("%x.json", key[:8])), nil
+}
+
+// loadJournal returns nil if there is no journal at the given location.
+func loadJournal(file string) (*journal, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	j := &journal{file: file}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("corrupt upload journal %s | %s", file, err)
+	}
+	if j.Parts == nil {
+		j.Parts = make(map[int64]string)
+	}
+	if err := j.readPartLog(); err != nil {
+		return nil, fmt.Errorf("corrupt upload journal %s | %s", j.partLog(), err)
+	}
+	return j, nil
+}
+
+// partLog is where done appends parts, so that recording one doesn't mean
+// rewriting all the others. save folds them back into the journal.
+func (j *journal) partLog() string {
+	return j.file + ".parts"
+}
+
+// readPartLog adds the parts in the log to the journal. A torn last line is
+// from a part that was never recorded, and is skipped.
+func (j *journal) readPartLog() error {
+	b, err := ioutil.ReadFile(j.partLog())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(b), "\n")
+	// everything after the last newline never finished being written
+	for _, line := range lines[:len(lines)-1] {
+		var (
+			start int64
+			hash  string
+		)
+		if _, err := fmt.Sscanf(line, "%d %s", &start, &hash); err != nil {
+			return fmt.Errorf("invalid part %q | %s", line, err)
+		}
+		j.Parts[start] = hash
+	}
+	return nil
+}
+
+func newJournal(file string, uploadID string, desc string, fp string, stats os.FileInfo, partSize int64) *journal {
+	return &journal{
+		UploadID:    uploadID,
+		Vault:       vault,
+		Description: desc,
+		PartSize:    partSize,
+		Path:        fp,
+		Size:        stats.Size(),
+		ModTime:     stats.ModTime(),
+		Parts:       make(map[int64]string),
+		file:        file,
+	}
+}
+
+// matches makes sure the file hasn't changed since the upload was started.
+func (j *journal) matches(stats os.FileInfo) error {
+	if j.Size != stats.Size() || !j.ModTime.Equal(stats.ModTime()) {
+		return fmt.Errorf("%s has changed since upload %s was started", j.Path, j.UploadID)
+	}
+	return nil
+}
+
+// uploaded returns a copy of the parts that have been uploaded so far.
+func (j *journal) uploaded() map[int64]string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	parts := make(map[int64]string, len(j.Parts))
+	for start, hash := range j.Parts {
+		parts[start] = hash
+	}
+	return parts
+}
+
+// done records a part as uploaded by appending it to the part log, which is
+// synced before returning.
+func (j *journal) done(start int64, hash string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.OpenFile(j.partLog(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d %s\n", start, hash); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	j.Parts[start] = hash
+	return nil
+}
+
+// save replaces the journal atomically so a crash never leaves half of one on
+// disk. The part log goes first, since its parts are in the new journal or no
+// longer belong in it.
+func (j *journal) save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := removeFile(j.partLog()); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.file, b)
+}
+
+func (j *journal) remove() error {
+	if err := removeFile(j.file); err != nil {
+		return err
+	}
+	return removeFile(j.partLog())
+}
+
+// removeFile is os.Remove without the error for a file that's already gone.
+func removeFile(file string) error {
+	err := os.Remove(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// writeFileAtomic writes to a temporary file in the same directory and renames
+// it over the destination.
+func writeFileAtomic(file string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+func TestResumeUpload(t *testing.T) {
+	home, err := ioutil.TempDir("", "glacier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	oldVault, oldRegion, oldResume, oldConcurrency, oldBudget, oldAttempts, oldUploads := vault, region, resume, concurrency, budget, maxAttempts, uploads
+	defer func() {
+		vault, region, resume, concurrency, budget, maxAttempts, uploads = oldVault, oldRegion, oldResume, oldConcurrency, oldBudget, oldAttempts, oldUploads
+	}()
+	vault, region, resume, concurrency, maxAttempts = "photos", "us-east-1", true, 2, 1
+	budget = newRequestBudget(concurrency)
+
+	data := make([]byte, 7<<19)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	fp := filepath.Join(home, "big.bin")
+	if err := ioutil.WriteFile(fp, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := os.Stat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second part made it up before the last run died
+	jf, err := journalFile(vault, fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := newJournal(jf, "upload", "big.bin", fp, stats, minPartSize)
+	j.Parts[minPartSize] = fmt.Sprintf("%x", glacier.ComputeHashes(bytes.NewReader(data[minPartSize:2*minPartSize])).TreeHash)
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu       sync.Mutex
+		parts    []string
+		treeHash string
+	)
+	svc, closeServer := testGlacier(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/multipart-uploads/upload") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "PUT":
+			parts = append(parts, r.Header.Get("Content-Range"))
+			w.Header().Set("x-amz-sha256-tree-hash", r.Header.Get("x-amz-sha256-tree-hash"))
+			w.WriteHeader(http.StatusNoContent)
+		case "POST":
+			treeHash = r.Header.Get("x-amz-sha256-tree-hash")
+			w.Header().Set("x-amz-archive-id", "archive")
+			w.Header().Set("x-amz-sha256-tree-hash", treeHash)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer closeServer()
+
+	uploads = newProgress(1, 0)
+	err = uploadFileMultipart(svc, fp)
+	uploads.stop()
+	if err != nil {
+		t.Fatalf("uploadFileMultipart failed | %s", err)
+	}
+
+	for _, p := range parts {
+		if strings.HasPrefix(p, fmt.Sprintf("bytes %d-", minPartSize)) {
+			t.Errorf("part %s was sent again", p)
+		}
+	}
+	if len(parts) != 3 {
+		t.Errorf("sent %d part(s), expected 3", len(parts))
+	}
+
+	expected := fmt.Sprintf("%x", glacier.ComputeHashes(bytes.NewReader(data)).TreeHash)
+	if treeHash != expected {
+		t.Errorf("tree hash = %s, expected %s", treeHash, expected)
+	}
+
+	if _, err := os.Stat(jf); !os.IsNotExist(err) {
+		t.Errorf("journal %s wasn't removed", jf)
+	}
+}
+
+func TestJournalPartLog(t *testing.T) {
+	home, err := ioutil.TempDir("", "glacier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	fp := filepath.Join(home, "big.bin")
+	if err := ioutil.WriteFile(fp, make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := os.Stat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jf := filepath.Join(home, "uploads", "big.json")
+	j := newJournal(jf, "upload", "big.bin", fp, stats, minPartSize)
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+	for i, hash := range []string{"aa", "bb", "cc"} {
+		if err := j.done(int64(i)*minPartSize, hash); err != nil {
+			t.Fatalf("done failed | %s", err)
+		}
+	}
+
+	// the process died halfway through recording a part
+	f, err := os.OpenFile(j.partLog(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("3145728 d")
+	f.Close()
+
+	loaded, err := loadJournal(jf)
+	if err != nil {
+		t.Fatalf("loadJournal failed | %s", err)
+	}
+	expected := map[int64]string{0: "aa", minPartSize: "bb", 2 * minPartSize: "cc"}
+	if fmt.Sprint(loaded.Parts) != fmt.Sprint(expected) {
+		t.Errorf("parts = %v, expected %v", loaded.Parts, expected)
+	}
+
+	// a new journal in the same place doesn't inherit the old parts
+	j = newJournal(jf, "another upload", "big.bin", fp, stats, minPartSize)
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = loadJournal(jf)
+	if err != nil {
+		t.Fatalf("loadJournal failed | %s", err)
+	}
+	if len(loaded.Parts) != 0 {
+		t.Errorf("parts = %v, expected none", loaded.Parts)
+	}
+
+	if err := j.done(0, "aa"); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.remove(); err != nil {
+		t.Fatalf("remove failed | %s", err)
+	}
+	for _, file := range []string{jf, j.partLog()} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed", file)
+		}
+	}
+}
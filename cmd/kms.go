@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// kmsDataKey asks KMS for a new data key under keyID. The plaintext key
+// encrypts the archive and the wrapped one goes in the archive's metadata.
+func kmsDataKey(kmsSvc *kms.KMS, keyID string) ([]byte, string, error) {
+	result, err := kmsSvc.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, "", formatKMSError(err)
+	}
+
+	return result.Plaintext, base64.StdEncoding.EncodeToString(result.CiphertextBlob), nil
+}
+
+// kmsArchiveKey unwraps the data key of an archive encrypted by kmsDataKey.
+func kmsArchiveKey(kmsSvc *kms.KMS, wrapped string) func(encryptionHeader) ([]byte, error) {
+	return func(h encryptionHeader) ([]byte, error) {
+		if h.KDF != kdfNone {
+			return nil, fmt.Errorf("archive was not encrypted with a KMS data key")
+		}
+
+		blob, err := base64.StdEncoding.DecodeString(wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wrapped KMS key | %s", err)
+		}
+
+		result, err := kmsSvc.Decrypt(&kms.DecryptInput{
+			CiphertextBlob: blob,
+		})
+		if err != nil {
+			return nil, formatKMSError(err)
+		}
+		return result.Plaintext, nil
+	}
+}
+
+func formatKMSError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		return fmt.Errorf("KMS %s | %s", aerr.Code(), aerr.Message())
+	}
+	return err
+}
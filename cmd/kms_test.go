@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// fakeKMS "wraps" data keys by prefixing them, which is enough to check that
+// they make the round trip through the archive metadata.
+func fakeKMS(w http.ResponseWriter, r *http.Request) {
+	var input map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&input)
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch r.Header.Get("X-Amz-Target") {
+	case "TrentService.GenerateDataKey":
+		key := bytes.Repeat([]byte{7}, 32)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"KeyId":          input["KeyId"],
+			"Plaintext":      key,
+			"CiphertextBlob": append([]byte("wrapped:"), key...),
+		})
+	case "TrentService.Decrypt":
+		var blob []byte
+		json.Unmarshal([]byte(`"`+input["CiphertextBlob"].(string)+`"`), &blob)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Plaintext": bytes.TrimPrefix(blob, []byte("wrapped:")),
+		})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestKMSRoundTrip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(fakeKMS))
+	defer server.Close()
+
+	kmsSvc := kms.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})))
+
+	key, wrapped, err := kmsDataKey(kmsSvc, "alias/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := []byte("archive contents")
+	er, err := encryptStream(bytes.NewReader(plain), key, newKMSHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := archiveMetadata{Name: "test", Encrypt: encryptionName, KMSKey: wrapped}
+	r, err := decodeArchive(er, m, nil, kmsSvc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, decrypted) {
+		t.Errorf("expected %s, got %s", plain, decrypted)
+	}
+}
@@ -1,45 +1,329 @@
 package cmd
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
 	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	listSource  string
+	listPath    string
+	listMinSize string
+	listMaxSize string
+	listSince   string
+	listUntil   string
+	listSort    string
+	listReverse bool
+	listOutput  string
+)
+
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all archives in a vault",
+	Long: `Archives come from the local catalog of uploads and the last inventory of the
+vault downloaded by the inventory command. Neither needs AWS credentials.`,
+	// everything is local, so there's no need to connect to AWS
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		region, err = cmd.Flags().GetString("region")
+		return err
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		// profile, err := cmd.Flags().GetString("profile")
-		// if err != nil {
-		// 	return err
-		// }
-
-		// sess, err := session.NewSession(&aws.Config{
-		// 	Region:      aws.String(region),
-		// 	Credentials: credentials.NewSharedCredentials("", profile),
-		// })
-		// if err != nil {
-		// 	return err
-		// }
-
-		// _, err = sess.Config.Credentials.Get()
-		// if err != nil {
-		// 	return fmt.Errorf("AWS credentials error | %s", err)
-		// }
-
-		// svc := glacier.New(sess)
-
-		return nil
+		f, err := newListFilter()
+		if err != nil {
+			return err
+		}
+
+		archives, err := listArchives(listSource)
+		if err != nil {
+			return err
+		}
+
+		var filtered []listedArchive
+		for _, a := range archives {
+			if f.matches(a) {
+				filtered = append(filtered, a)
+			}
+		}
+
+		if err := sortArchives(filtered, listSort, listReverse); err != nil {
+			return err
+		}
+
+		return printArchives(filtered, listOutput)
 	},
 }
 
 func init() {
-	listCmd.Flags().StringVarP(&region, "region", "r", "us-east-1", "AWS region of the vault")
-
 	listCmd.Flags().StringVarP(&vault, "vault", "v", "", "Vault name")
 	err := listCmd.MarkFlagRequired("vault")
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	listCmd.Flags().StringVar(&listSource, "source", "all", "Where to list archives from (catalog, inventory, all)")
+	listCmd.Flags().StringVar(&listPath, "path", "", "Only archives whose path (or name) matches this glob")
+	listCmd.Flags().StringVar(&listMinSize, "min-size", "", "Only archives at least this big, e.g. 500M")
+	listCmd.Flags().StringVar(&listMaxSize, "max-size", "", "Only archives at most this big, e.g. 2G")
+	listCmd.Flags().StringVar(&listSince, "since", "", "Only archives uploaded on or after this date (YYYY-MM-DD or RFC 3339)")
+	listCmd.Flags().StringVar(&listUntil, "until", "", "Only archives uploaded before this date (YYYY-MM-DD or RFC 3339)")
+	listCmd.Flags().StringVar(&listSort, "sort", "date", "Sort by name, path, size or date")
+	listCmd.Flags().BoolVar(&listReverse, "reverse", false, "Reverse the sort order")
+	listCmd.Flags().StringVarP(&listOutput, "output", "o", "table", "Output format (table, json, csv)")
+}
+
+// listedArchive is an archive as known to the catalog, the inventory or both.
+type listedArchive struct {
+	ArchiveID string    `json:"archive_id"`
+	Name      string    `json:"name"`
+	Path      string    `json:"path,omitempty"`
+	Size      int64     `json:"size"`
+	Date      time.Time `json:"date"`
+	TreeHash  string    `json:"tree_hash"`
+	Source    string    `json:"source"`
+}
+
+// listArchives merges the catalog and cached inventory of the vault. The
+// catalog knows more about an archive, so its details win.
+func listArchives(source string) ([]listedArchive, error) {
+	var (
+		archives []listedArchive
+		index    = make(map[string]int)
+	)
+
+	if source == "all" || source == "inventory" {
+		snap, err := loadSnapshot(region, vault)
+		if err != nil {
+			return nil, err
+		}
+		if snap != nil {
+			for _, a := range snap.Archives {
+				index[a.ArchiveID] = len(archives)
+				archives = append(archives, listedArchive{
+					ArchiveID: a.ArchiveID,
+					Name:      parseDescription(a.Description).Name,
+					Size:      a.Size,
+					Date:      a.CreationDate,
+					TreeHash:  a.TreeHash,
+					Source:    "inventory",
+				})
+			}
+		}
+	}
+
+	if source == "all" || source == "catalog" {
+		records, err := readCatalog()
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range records {
+			if rec.Vault != vault || rec.Region != region {
+				continue
+			}
+
+			a := listedArchive{
+				ArchiveID: rec.ArchiveID,
+				Name:      parseDescription(rec.Description).Name,
+				Path:      rec.Path,
+				Size:      rec.Size,
+				Date:      rec.UploadedAt,
+				TreeHash:  rec.TreeHash,
+				Source:    "catalog",
+			}
+			if i, ok := index[rec.ArchiveID]; ok {
+				a.Source = "both"
+				archives[i] = a
+				continue
+			}
+			index[rec.ArchiveID] = len(archives)
+			archives = append(archives, a)
+		}
+	}
+
+	if source != "all" && source != "inventory" && source != "catalog" {
+		return nil, fmt.Errorf("invalid source: %s", source)
+	}
+	return archives, nil
+}
+
+type listFilter struct {
+	path    string
+	minSize int64
+	maxSize int64
+	since   time.Time
+	until   time.Time
+}
+
+func newListFilter() (*listFilter, error) {
+	f := &listFilter{path: listPath, maxSize: -1}
+
+	var err error
+	if listMinSize != "" {
+		if f.minSize, err = parseSize(listMinSize); err != nil {
+			return nil, err
+		}
+	}
+	if listMaxSize != "" {
+		if f.maxSize, err = parseSize(listMaxSize); err != nil {
+			return nil, err
+		}
+	}
+	if listSince != "" {
+		if f.since, err = parseDate(listSince); err != nil {
+			return nil, err
+		}
+	}
+	if listUntil != "" {
+		if f.until, err = parseDate(listUntil); err != nil {
+			return nil, err
+		}
+	}
+	if f.path != "" {
+		if _, err := filepath.Match(f.path, ""); err != nil {
+			return nil, fmt.Errorf("invalid path glob: %s", f.path)
+		}
+	}
+	return f, nil
+}
+
+func (f *listFilter) matches(a listedArchive) bool {
+	if f.path != "" {
+		subject := a.Path
+		if subject == "" {
+			subject = a.Name
+		}
+		// globs without a separator are matched against the file name alone
+		if !strings.ContainsRune(f.path, filepath.Separator) {
+			subject = filepath.Base(subject)
+		}
+		if ok, _ := filepath.Match(f.path, subject); !ok {
+			return false
+		}
+	}
+	if a.Size < f.minSize || (f.maxSize >= 0 && a.Size > f.maxSize) {
+		return false
+	}
+	if !f.since.IsZero() && a.Date.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !a.Date.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+func sortArchives(archives []listedArchive, by string, reverse bool) error {
+	var less func(a, b listedArchive) bool
+	switch by {
+	case "name":
+		less = func(a, b listedArchive) bool { return a.Name < b.Name }
+	case "path":
+		less = func(a, b listedArchive) bool { return a.Path < b.Path }
+	case "size":
+		less = func(a, b listedArchive) bool { return a.Size < b.Size }
+	case "date":
+		less = func(a, b listedArchive) bool { return a.Date.Before(b.Date) }
+	default:
+		return fmt.Errorf("invalid sort: %s", by)
+	}
+
+	sort.SliceStable(archives, func(i, j int) bool {
+		if reverse {
+			return less(archives[j], archives[i])
+		}
+		return less(archives[i], archives[j])
+	})
+	return nil
+}
+
+func printArchives(archives []listedArchive, output string) error {
+	switch output {
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "DATE\tSIZE\tNAME\tPATH\tSOURCE\tARCHIVE ID")
+		for _, a := range archives {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", a.Date.Format("2006-01-02 15:04"), formatSize(a.Size), a.Name, a.Path, a.Source, a.ArchiveID)
+		}
+		return w.Flush()
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if archives == nil {
+			archives = []listedArchive{}
+		}
+		return enc.Encode(archives)
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"archive_id", "name", "path", "size", "date", "tree_hash", "source"})
+		for _, a := range archives {
+			w.Write([]string{a.ArchiveID, a.Name, a.Path, strconv.FormatInt(a.Size, 10), a.Date.Format(time.RFC3339), a.TreeHash, a.Source})
+		}
+		w.Flush()
+		return w.Error()
+	default:
+		return fmt.Errorf("invalid output: %s", output)
+	}
+}
+
+var sizeUnits = []string{"B", "K", "M", "G", "T", "P"}
+
+// parseSize reads a byte count with an optional binary unit, e.g. 512, 10K, 2.5G.
+func parseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+
+	multiplier := float64(1)
+	for i, unit := range sizeUnits[1:] {
+		if strings.HasSuffix(s, unit) {
+			s = strings.TrimSuffix(s, unit)
+			multiplier = float64(int64(1) << (10 * uint(i+1)))
+			break
+		}
+	}
+
+	// ParseFloat takes "NaN" and "Inf", and the product has to fit in an int64
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(n) || n < 0 || n*multiplier >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return int64(n * multiplier), nil
+}
+
+// formatSize is the inverse of parseSize, to one decimal place.
+func formatSize(n int64) string {
+	size := float64(n)
+	for _, unit := range sizeUnits {
+		if size < 1024 || unit == sizeUnits[len(sizeUnits)-1] {
+			if unit == "B" {
+				return fmt.Sprintf("%d%s", n, unit)
+			}
+			return fmt.Sprintf("%.1f%s", size, unit)
+		}
+		size /= 1024
+	}
+	return ""
+}
+
+// parseDate accepts a plain date (midnight UTC) or an RFC 3339 timestamp.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid date: %s (expected YYYY-MM-DD or RFC 3339)", s)
+	}
+	return t, nil
 }
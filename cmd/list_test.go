@@ -0,0 +1,49 @@
+package cmd
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"0":     0,
+		"512":   512,
+		"10K":   10 << 10,
+		"10KB":  10 << 10,
+		"10kib": 10 << 10,
+		"2.5G":  5 << 29,
+		"1T":    1 << 40,
+	}
+
+	for s, expected := range tests {
+		n, err := parseSize(s)
+		if err != nil {
+			t.Errorf("parseSize(%q) failed | %s", s, err)
+			continue
+		}
+		if n != expected {
+			t.Errorf("parseSize(%q) = %d, expected %d", s, n, expected)
+		}
+	}
+
+	for _, s := range []string{"", "G", "-1", "-0.5K", "ten", "NaN", "nanK", "Inf", "+InfG", "-Inf", "8192P", "1e300"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("parseSize(%q) should have failed", s)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[int64]string{
+		0:           "0B",
+		1023:        "1023B",
+		1024:        "1.0K",
+		5 << 29:     "2.5G",
+		3 << 50:     "3.0P",
+		int64(1e18): "888.2P",
+	}
+
+	for n, expected := range tests {
+		if s := formatSize(n); s != expected {
+			t.Errorf("formatSize(%d) = %s, expected %s", n, s, expected)
+		}
+	}
+}
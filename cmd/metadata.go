@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// Glacier only allows printable ASCII in descriptions, up to 1024 characters.
+const maxDescriptionLength = 1024
+
+// archiveMetadata is kept in an archive's description so that whatever reads
+// the archive back knows how to undo what was done to it on the way up.
+type archiveMetadata struct {
+	Name     string `json:"name"`
+	Compress string `json:"compress,omitempty"`
+	Encrypt  string `json:"encrypt,omitempty"`
+	// base64 KMS encrypted data key, if the archive was encrypted with one
+	KMSKey string `json:"kms_key,omitempty"`
+}
+
+// description encodes the metadata. Archives that were uploaded as-is just get
+// their name, the same as before metadata existed.
+func (m archiveMetadata) description() (string, error) {
+	if m == (archiveMetadata{Name: m.Name}) && isPrintableASCII(m.Name) && !strings.HasPrefix(m.Name, "{") {
+		return m.Name, nil
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	desc := asciiJSON(b)
+	if len(desc) > maxDescriptionLength {
+		return "", fmt.Errorf("archive description is longer than %d characters: %s", maxDescriptionLength, desc)
+	}
+	return desc, nil
+}
+
+// parseDescription reverses description. Descriptions that aren't metadata,
+// e.g. archives uploaded by other tools, are treated as a plain name.
+func parseDescription(desc string) archiveMetadata {
+	var m archiveMetadata
+	if strings.HasPrefix(desc, "{") && json.Unmarshal([]byte(desc), &m) == nil {
+		return m
+	}
+	return archiveMetadata{Name: desc}
+}
+
+// decodeArchive undoes whatever the metadata says was done to an archive on
+// upload. keys is only needed for archives encrypted without KMS.
+func decodeArchive(r io.Reader, m archiveMetadata, keys *keySource, kmsSvc *kms.KMS) (io.Reader, error) {
+	if m.Encrypt != "" {
+		if m.Encrypt != encryptionName {
+			return nil, fmt.Errorf("unsupported encryption: %s", m.Encrypt)
+		}
+
+		var err error
+		switch {
+		case m.KMSKey != "":
+			r, err = decryptStream(r, kmsArchiveKey(kmsSvc, m.KMSKey))
+		case keys != nil:
+			r, err = decryptStream(r, keys.archiveKey)
+		default:
+			err = fmt.Errorf("archive is encrypted, a key file or passphrase is needed")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.Compress != "" {
+		return decompressStream(r, m.Compress)
+	}
+	return r, nil
+}
+
+func isPrintableASCII(s string) bool {
+	for _, r := range s {
+		if r < 0x20 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// asciiJSON escapes everything outside printable ASCII in already encoded JSON.
+func asciiJSON(b []byte) string {
+	var buf bytes.Buffer
+	for _, r := range string(b) {
+		if r >= 0x20 && r <= 0x7e {
+			buf.WriteRune(r)
+			continue
+		}
+
+		if r1, r2 := utf16.EncodeRune(r); r1 != unicode.ReplacementChar {
+			fmt.Fprintf(&buf, `\u%04x\u%04x`, r1, r2)
+		} else {
+			fmt.Fprintf(&buf, `\u%04x`, r)
+		}
+	}
+	return buf.String()
+}
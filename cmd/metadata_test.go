@@ -0,0 +1,33 @@
+package cmd
+
+import "testing"
+
+func TestDescriptionRoundTrip(t *testing.T) {
+	tests := []struct {
+		metadata archiveMetadata
+		expected string
+	}{
+		{metadata: archiveMetadata{Name: "backup.tar"}, expected: "backup.tar"},
+		{metadata: archiveMetadata{Name: "backup.tar", Compress: "gzip"}, expected: `{"name":"backup.tar","compress":"gzip"}`},
+		{metadata: archiveMetadata{Name: "résumé 📄.pdf"}, expected: `{"name":"r\u00e9sum\u00e9 \ud83d\udcc4.pdf"}`},
+		{metadata: archiveMetadata{Name: "{not json"}, expected: `{"name":"{not json"}`},
+	}
+
+	for _, test := range tests {
+		desc, err := test.metadata.description()
+		if err != nil {
+			t.Errorf("%+v failed | %s", test.metadata, err)
+			continue
+		}
+		if desc != test.expected {
+			t.Errorf("expected description %s, got %s", test.expected, desc)
+		}
+		if m := parseDescription(desc); m != test.metadata {
+			t.Errorf("expected %+v back, got %+v", test.metadata, m)
+		}
+	}
+
+	if m := parseDescription("uploaded elsewhere"); m.Name != "uploaded elsewhere" {
+		t.Errorf("expected plain descriptions to be names, got %+v", m)
+	}
+}
@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/nickvanw/treehash"
+)
+
+// Glacier's multipart limits
+const (
+	minPartSize    = int64(1 << 20) // 1MiB
+	maxPartSize    = int64(1 << 32) // 4GiB
+	maxArchiveSize = 10000 * maxPartSize
+
+	// streams have no size to pick a part size from, this allows for ~625GiB
+	streamPartSize = int64(64 << 20)
+)
+
+// maxParts is the most parts an upload can have, only lowered by tests.
+var maxParts = int64(10000)
+
+// selectPartSize validates the requested part size (in MiB), or picks the
+// smallest one that keeps the file under Glacier's part limit if none was given.
+func selectPartSize(totalSize int64, mib int64) (int64, error) {
+	if totalSize > maxArchiveSize {
+		return 0, fmt.Errorf("file is larger than the maximum archive size of %d bytes", maxArchiveSize)
+	}
+
+	if mib == 0 {
+		partSize := minPartSize
+		for partSize*maxParts < totalSize {
+			partSize *= 2
+		}
+		return partSize, nil
+	}
+
+	partSize := mib << 20
+	if mib < 0 || partSize < minPartSize || partSize > maxPartSize || partSize&(partSize-1) != 0 {
+		return 0, fmt.Errorf("invalid part size: %dMiB is not a power of two between 1MiB and 4096MiB", mib)
+	}
+	if partSize*maxParts < totalSize {
+		return 0, fmt.Errorf("invalid part size: %dMiB would need more than %d parts", mib, maxParts)
+	}
+	return partSize, nil
+}
+
+// errEmptyArchive is returned for empty input, which Glacier has no way to
+// store.
+var errEmptyArchive = fmt.Errorf("nothing to upload, Glacier doesn't take empty archives")
+
+// part is a chunk of an archive waiting to be uploaded.
+type part struct {
+	buf   []byte
+	start int64
+	end   int64
+	hash  string
+}
+
+// initiateUpload starts a multipart upload and returns its ID.
+func initiateUpload(svc *glacier.Glacier, description string, partSize int64) (string, error) {
+	result, err := svc.InitiateMultipartUpload(&glacier.InitiateMultipartUploadInput{
+		AccountId:          aws.String("-"),
+		ArchiveDescription: aws.String(description),
+		PartSize:           aws.String(fmt.Sprintf("%d", partSize)),
+		VaultName:          aws.String(vault),
+	})
+	if err != nil {
+		return "", formatAWSError(err)
+	}
+	return *result.UploadId, nil
+}
+
+// requestBudget caps the number of parts held in memory and requests in flight
+// across every upload going on at once.
+type requestBudget chan struct{}
+
+var budget requestBudget
+
+func newRequestBudget(n int) requestBudget {
+	return make(requestBudget, n)
+}
+
+// acquire waits for room in the budget, giving up if abort is closed first.
+func (b requestBudget) acquire(abort <-chan struct{}) bool {
+	select {
+	case b <- struct{}{}:
+		return true
+	case <-abort:
+		return false
+	}
+}
+
+func (b requestBudget) release() {
+	<-b
+}
+
+// multipartUpload sends the parts of an initiated multipart upload.
+type multipartUpload struct {
+	svc      *glacier.Glacier
+	uploadID string
+	partSize int64
+	// tree hashes of parts Glacier already has, keyed by their first byte
+	uploaded map[int64]string
+	// called after each part is uploaded, may be nil
+	onPart func(start int64, hash string) error
+	bar    *progressBar
+}
+
+// send splits r into parts and uploads the ones Glacier doesn't have yet. size
+// is the length of r, or -1 if it won't be known until r runs out. The size and
+// tree hash of the whole archive are returned.
+func (u *multipartUpload) send(r io.Reader, size int64) (int64, string, error) {
+	var th treehash.MultiTreeHash
+
+	parts := make(chan part, concurrency)
+
+	// the first part to give up stops the reader and the remaining workers
+	var (
+		once      sync.Once
+		uploadErr error
+	)
+	abort := make(chan struct{})
+	fail := func(err error) {
+		once.Do(func() {
+			uploadErr = err
+			close(abort)
+		})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range parts {
+				select {
+				case <-abort:
+				default:
+					if err := u.sendPart(p); err != nil {
+						fail(err)
+					}
+				}
+				budget.release()
+			}
+		}()
+	}
+
+	startB := int64(0)
+	for size < 0 || startB < size {
+		if startB/u.partSize >= maxParts {
+			// a stream that ends right where the last part does still fits
+			var b [1]byte
+			_, err := io.ReadFull(r, b[:])
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				err = fmt.Errorf("archive needs more than %d parts of %d bytes, use a bigger --part-size", maxParts, u.partSize)
+			}
+			fail(err)
+			break
+		}
+
+		// either the part size, or the amount remaining, whichever is smaller
+		contentLength := u.partSize
+		if size >= 0 && size-startB < u.partSize {
+			contentLength = size - startB
+		}
+
+		// parts from a previous run only need to be accounted for in the tree hash
+		if hash, ok := u.uploaded[startB]; ok {
+			if err := skip(r, contentLength); err != nil {
+				fail(err)
+				break
+			}
+			th.Add(hash)
+			u.bar.Add64(contentLength)
+			startB += contentLength
+			continue
+		}
+
+		if !budget.acquire(abort) {
+			break
+		}
+
+		buf := make([]byte, contentLength)
+		n, err := io.ReadFull(r, buf)
+		if size < 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			// the stream ran out, so this is the last (possibly empty) part
+			size = startB + int64(n)
+		} else if err != nil {
+			budget.release()
+			fail(err)
+			break
+		}
+		if n == 0 {
+			budget.release()
+			break
+		}
+
+		endB := startB + int64(n)
+
+		hash := fmt.Sprintf("%x", glacier.ComputeHashes(bytes.NewReader(buf[:n])).TreeHash)
+		th.Add(hash)
+
+		parts <- part{buf: buf[:n], start: startB, end: endB, hash: hash}
+
+		startB = endB
+	}
+
+	close(parts)
+	wg.Wait()
+
+	if uploadErr != nil {
+		return 0, "", uploadErr
+	}
+	// Glacier won't complete an upload without any parts
+	if startB == 0 {
+		return 0, "", errEmptyArchive
+	}
+	return startB, th.Hash(), nil
+}
+
+func (u *multipartUpload) sendPart(p part) error {
+	err := withRetries(maxAttempts, func() error {
+		_, err := u.svc.UploadMultipartPartWithContext(aws.BackgroundContext(), &glacier.UploadMultipartPartInput{
+			AccountId: aws.String("-"),
+			Body:      bytes.NewReader(p.buf),
+			Checksum:  aws.String(p.hash),
+			Range:     aws.String(fmt.Sprintf("bytes %d-%d/*", p.start, p.end-1)),
+			UploadId:  aws.String(u.uploadID),
+			VaultName: aws.String(vault),
+		}, noSDKRetries)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("part %d-%d failed | %s", p.start, p.end-1, formatAWSError(err))
+	}
+
+	if u.onPart != nil {
+		if err := u.onPart(p.start, p.hash); err != nil {
+			return err
+		}
+	}
+
+	u.bar.Add(len(p.buf))
+	return nil
+}
+
+func (u *multipartUpload) complete(size int64, treeHash string) (*glacier.ArchiveCreationOutput, error) {
+	result, err := u.svc.CompleteMultipartUpload(&glacier.CompleteMultipartUploadInput{
+		AccountId:   aws.String("-"),
+		ArchiveSize: aws.String(fmt.Sprintf("%d", size)),
+		Checksum:    aws.String(treeHash),
+		UploadId:    aws.String(u.uploadID),
+		VaultName:   aws.String(vault),
+	})
+	if err != nil {
+		return nil, formatAWSError(err)
+	}
+	return result, nil
+}
+
+// abort cancels the upload so Glacier can discard the parts it has.
+func (u *multipartUpload) abort() {
+	_, err := u.svc.AbortMultipartUpload(&glacier.AbortMultipartUploadInput{
+		AccountId: aws.String("-"),
+		UploadId:  aws.String(u.uploadID),
+		VaultName: aws.String(vault),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not abort upload %s | %s\n", u.uploadID, formatAWSError(err))
+	}
+}
+
+// skip moves past n bytes of r, seeking when it can.
+func skip(r io.Reader, n int64) error {
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, r, n)
+	return err
+}
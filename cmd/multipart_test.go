@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+func TestSend(t *testing.T) {
+	oldVault, oldConcurrency, oldBudget, oldAttempts, oldMaxParts := vault, concurrency, budget, maxAttempts, maxParts
+	defer func() {
+		vault, concurrency, budget, maxAttempts, maxParts = oldVault, oldConcurrency, oldBudget, oldAttempts, oldMaxParts
+	}()
+	vault, concurrency, maxAttempts = "photos", 2, 1
+	budget = newRequestBudget(concurrency)
+
+	tests := []struct {
+		name     string
+		size     int64
+		stream   bool
+		maxParts int64
+		// part ranges Glacier should get, or nil if send should fail
+		parts []string
+	}{
+		{name: "file", size: 5<<19 + 10, parts: []string{"0-1048575", "1048576-2097151", "2097152-2621449"}},
+		{name: "single part file", size: 10, parts: []string{"0-9"}},
+		{name: "stream", size: 5<<19 + 10, stream: true, parts: []string{"0-1048575", "1048576-2097151", "2097152-2621449"}},
+		{name: "stream ending on a part", size: 2 << 20, stream: true, parts: []string{"0-1048575", "1048576-2097151"}},
+		{name: "empty stream", size: 0, stream: true},
+		{name: "stream filling every part", size: 2 << 20, stream: true, maxParts: 2, parts: []string{"0-1048575", "1048576-2097151"}},
+		{name: "stream past the last part", size: 2<<20 + 1, stream: true, maxParts: 2},
+	}
+
+	for _, test := range tests {
+		maxParts = oldMaxParts
+		if test.maxParts > 0 {
+			maxParts = test.maxParts
+		}
+
+		data := make([]byte, test.size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+
+		var (
+			mu    sync.Mutex
+			parts []string
+		)
+		svc, closeServer := testGlacier(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			hash := fmt.Sprintf("%x", glacier.ComputeHashes(bytes.NewReader(body)).TreeHash)
+			if hash != r.Header.Get("x-amz-sha256-tree-hash") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			var start, end int64
+			fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/*", &start, &end)
+			mu.Lock()
+			parts = append(parts, fmt.Sprintf("%d-%d", start, end))
+			mu.Unlock()
+
+			w.Header().Set("x-amz-sha256-tree-hash", hash)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		p := newProgress(1, 0)
+		u := &multipartUpload{
+			svc:      svc,
+			uploadID: "upload",
+			partSize: minPartSize,
+			bar:      p.newBar(test.name, test.size),
+		}
+
+		var (
+			r    io.Reader = bytes.NewReader(data)
+			size           = test.size
+		)
+		if test.stream {
+			// hide the Seeker and the size
+			r, size = struct{ io.Reader }{r}, -1
+		}
+
+		sent, treeHash, err := u.send(r, size)
+		u.bar.Finish()
+		p.stop()
+		closeServer()
+
+		if test.parts == nil {
+			if err == nil {
+				t.Errorf("%s: send should have failed", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: send failed | %s", test.name, err)
+			continue
+		}
+
+		expected := fmt.Sprintf("%x", glacier.ComputeHashes(bytes.NewReader(data)).TreeHash)
+		if sent != test.size || treeHash != expected {
+			t.Errorf("%s: send = %d, %s, expected %d, %s", test.name, sent, treeHash, test.size, expected)
+		}
+
+		sort.Strings(parts)
+		if fmt.Sprint(parts) != fmt.Sprint(test.parts) {
+			t.Errorf("%s: parts = %v, expected %v", test.name, parts, test.parts)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/cheggaaa/pb.v2"
+	"gopkg.in/mattn/go-isatty.v0"
+)
+
+const (
+	fileBarTemplate   = `{{string . "name"}}: {{bar . | green}} {{counters . | blue }}`
+	streamBarTemplate = `{{string . "name"}}: {{counters . | blue }} {{speed . | green }}`
+	totalBarTemplate  = `total ({{string . "files"}}): {{bar . | green}} {{counters . | blue }} {{speed . | green }}`
+)
+
+// progress draws a bar for every archive being uploaded, and one for all of
+// them together when there's more than one. Finished bars are printed once and
+// left to scroll up.
+type progress struct {
+	mu       sync.Mutex
+	active   []*pb.ProgressBar
+	total    *pb.ProgressBar
+	files    int
+	finished int
+	lines    int
+	terminal bool
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// progressBar is one archive's bar, which also counts towards the total.
+type progressBar struct {
+	bar *pb.ProgressBar
+	p   *progress
+}
+
+// newProgress starts drawing. totalSize is the number of bytes across all of
+// the files, or 0 if it isn't known.
+func newProgress(files int, totalSize int64) *progress {
+	p := &progress{
+		files:    files,
+		terminal: isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd()),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if files > 1 {
+		p.total = pb.New64(totalSize).SetTemplateString(totalBarTemplate).Set(pb.Static, true).Start()
+		p.total.Set("files", fmt.Sprintf("0/%d files", files))
+	}
+
+	go func() {
+		defer close(p.done)
+		if !p.terminal {
+			<-p.quit
+			return
+		}
+
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mu.Lock()
+				p.draw()
+				p.mu.Unlock()
+			case <-p.quit:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// newBar adds a bar for an archive of the given size, or 0 if it isn't known.
+func (p *progress) newBar(name string, size int64) *progressBar {
+	tmpl := fileBarTemplate
+	if size <= 0 {
+		tmpl = streamBarTemplate
+	}
+
+	bar := pb.New64(size).SetTemplateString(tmpl).Set(pb.Static, true).Set("name", name).Start()
+
+	p.mu.Lock()
+	p.active = append(p.active, bar)
+	p.mu.Unlock()
+
+	return &progressBar{bar: bar, p: p}
+}
+
+func (b *progressBar) Add(n int) {
+	b.Add64(int64(n))
+}
+
+func (b *progressBar) Add64(n int64) {
+	b.bar.Add64(n)
+	if b.p.total != nil {
+		b.p.total.Add64(n)
+	}
+}
+
+// Finish prints the bar for the last time.
+func (b *progressBar) Finish() {
+	p := b.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, bar := range p.active {
+		if bar == b.bar {
+			p.active = append(p.active[:i], p.active[i+1:]...)
+			break
+		}
+	}
+	b.bar.Finish()
+
+	p.clear()
+	fmt.Fprintln(os.Stderr, b.bar.String())
+
+	p.finished++
+	if p.total != nil {
+		p.total.Set("files", fmt.Sprintf("%d/%d files", p.finished, p.files))
+	}
+	p.draw()
+}
+
+// printf prints to stdout without the bars getting in the way.
+func (p *progress) printf(format string, a ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+	fmt.Printf(format, a...)
+	p.draw()
+}
+
+// stop draws the final state of the total.
+func (p *progress) stop() {
+	close(p.quit)
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+	if p.total != nil {
+		p.total.Finish()
+		fmt.Fprintln(os.Stderr, p.total.String())
+	}
+}
+
+// draw redraws the active bars over the last ones drawn. Only terminals get
+// live bars, everything else just gets the finished ones.
+func (p *progress) draw() {
+	if !p.terminal {
+		return
+	}
+
+	p.clear()
+	for _, bar := range p.active {
+		fmt.Fprintln(os.Stderr, bar.String())
+	}
+	if p.total != nil {
+		fmt.Fprintln(os.Stderr, p.total.String())
+	}
+	p.lines = len(p.active)
+	if p.total != nil {
+		p.lines++
+	}
+}
+
+// clear erases the lines drawn by draw.
+func (p *progress) clear() {
+	if !p.terminal {
+		return
+	}
+
+	for ; p.lines > 0; p.lines-- {
+		fmt.Fprint(os.Stderr, "\033[1A\033[2K")
+	}
+}
@@ -0,0 +1,300 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/spf13/cobra"
+)
+
+var (
+	restorePrefix  string
+	restoreDest    string
+	restoreBatch   int
+	restoreTimeout time.Duration
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore every uploaded file under a path",
+	Long: `Looks up the files uploaded from under --prefix in the local catalog, retrieves
+them and rebuilds them under --dest with their original modification times and
+permissions. Directories uploaded with --archive tar are extracted in place. A
+prefix ending in a slash restores what's inside it, otherwise the last element
+of the prefix is kept, like rsync.
+
+At most --batch retrieval jobs are kept going at once. Jobs are remembered
+locally and files that have already been restored are skipped, so an
+interrupted restore can be run again to pick up where it left off.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !validTier(tier) {
+			return fmt.Errorf("invalid tier: %s (want one of %s)", tier, strings.Join(tiers, ", "))
+		}
+
+		if restoreBatch < 1 {
+			return fmt.Errorf("invalid batch: must be at least 1")
+		}
+
+		if concurrency < 1 {
+			return fmt.Errorf("invalid concurrency: must be at least 1")
+		}
+		budget = newRequestBudget(concurrency)
+
+		if waitInterval <= 0 {
+			return fmt.Errorf("invalid interval: must be more than 0")
+		}
+
+		var err error
+		kmsSvc, err = newKMS(cmd)
+		if err != nil {
+			return err
+		}
+
+		files, err := restoreFiles(restorePrefix, restoreDest)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("nothing in the catalog for %s was uploaded from under %s", vault, restorePrefix)
+		}
+
+		var todo []restoreFile
+		for _, f := range files {
+			if f.restored() {
+				fmt.Printf("Skipping %s, already restored\n", f.out)
+				continue
+			}
+			todo = append(todo, f)
+		}
+
+		failed := restoreAll(todo)
+		if failed > 0 {
+			return fmt.Errorf("%d of %d file(s) failed to restore", failed, len(todo))
+		}
+		return nil
+	},
+}
+
+func init() {
+	restoreCmd.Flags().StringVarP(&vault, "vault", "v", "", "Vault name")
+	err := restoreCmd.MarkFlagRequired("vault")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	restoreCmd.Flags().StringVarP(&restorePrefix, "prefix", "p", "", "Restore files that were uploaded from under this path")
+	err = restoreCmd.MarkFlagRequired("prefix")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	restoreCmd.Flags().StringVar(&restoreDest, "dest", "", "Directory to restore the files into")
+	err = restoreCmd.MarkFlagRequired("dest")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	restoreCmd.Flags().StringVar(&tier, "tier", "Standard", "Retrieval tier (Expedited, Standard, Bulk)")
+	restoreCmd.Flags().IntVar(&restoreBatch, "batch", 10, "Number of retrieval jobs to have going at once")
+	restoreCmd.Flags().StringVarP(&sns, "sns", "s", "", "SNS topic to notify as each archive is ready")
+	restoreCmd.Flags().DurationVar(&waitInterval, "interval", 15*time.Minute, "How often to check on the jobs")
+	restoreCmd.Flags().DurationVar(&restoreTimeout, "timeout", 48*time.Hour, "How long to wait before giving up (0 waits forever)")
+	restoreCmd.Flags().StringVar(&keyFile, "key-file", "", "Key file the archives were encrypted with")
+	restoreCmd.Flags().StringVar(&passphraseFile, "passphrase-file", "", "File holding the passphrase the archives were encrypted with (also read from $"+passphraseEnv+" or prompted for)")
+	restoreCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 4, "Number of chunks to download at once")
+	restoreCmd.Flags().IntVar(&maxAttempts, "max-attempts", 5, "Maximum number of times to try each request")
+}
+
+// restoreFile is a file to rebuild from an archive in the catalog.
+type restoreFile struct {
+	rec catalogRecord
+	out string
+	job *pendingJob
+}
+
+// restoreFiles finds the latest upload of every file under prefix and works
+// out where under dest each one goes.
+func restoreFiles(prefix string, dest string) ([]restoreFile, error) {
+	abs, err := filepath.Abs(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	base := filepath.Dir(abs)
+	if strings.HasSuffix(prefix, "/") || strings.HasSuffix(prefix, string(filepath.Separator)) {
+		base = abs
+	}
+
+	records, err := readCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	// later uploads of the same file replace earlier ones
+	latest := make(map[string]catalogRecord)
+	var order []string
+	for _, rec := range records {
+		if rec.Vault != vault || rec.Region != region || rec.Path == "" {
+			continue
+		}
+		if rec.Path != abs && !strings.HasPrefix(rec.Path, abs+string(filepath.Separator)) {
+			continue
+		}
+		if _, ok := latest[rec.Path]; !ok {
+			order = append(order, rec.Path)
+		}
+		latest[rec.Path] = rec
+	}
+
+	var files []restoreFile
+	for _, fp := range order {
+		rel, err := filepath.Rel(base, fp)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, restoreFile{
+			rec: latest[fp],
+			out: filepath.Join(dest, rel),
+		})
+	}
+	return files, nil
+}
+
+// restored is true if the file is already in place with its original
+// modification time.
+func (f restoreFile) restored() bool {
+	stats, err := os.Stat(f.out)
+	return err == nil && stats.ModTime().Equal(f.rec.ModTime)
+}
+
+// restoreAll keeps up to restoreBatch jobs going, downloading each one as it
+// finishes, until every file is restored or the timeout runs out. It returns
+// the number of files that couldn't be restored.
+func restoreAll(files []restoreFile) int {
+	var deadline time.Time
+	if restoreTimeout > 0 {
+		deadline = time.Now().Add(restoreTimeout)
+	}
+
+	var (
+		active []restoreFile
+		failed int
+	)
+	for len(files) > 0 || len(active) > 0 {
+		for len(active) < restoreBatch && len(files) > 0 {
+			f := files[0]
+			files = files[1:]
+
+			job, err := retrievalJob(f.rec.ArchiveID, nil, f.out)
+			if err != nil {
+				fmt.Printf("%s failed | %s\n", f.out, err)
+				failed++
+				continue
+			}
+			f.job = job
+			active = append(active, f)
+		}
+
+		var (
+			waiting []restoreFile
+			changed bool
+		)
+		for _, f := range active {
+			done, err := f.finish()
+			if err != nil {
+				fmt.Printf("%s failed | %s\n", f.out, err)
+				failed++
+			}
+			if done || err != nil {
+				changed = true
+				continue
+			}
+			waiting = append(waiting, f)
+		}
+		active = waiting
+
+		if len(active) == 0 || changed {
+			continue
+		}
+
+		if !deadline.IsZero() && time.Now().Add(waitInterval).After(deadline) {
+			fmt.Printf("%d file(s) still waiting on their jobs after %s, run this again to pick them up\n", len(active)+len(files), restoreTimeout)
+			return failed + len(active) + len(files)
+		}
+
+		fmt.Printf("Waiting on %d job(s), %d more file(s) to go, checking again in %s\n", len(active), len(files), waitInterval)
+		time.Sleep(waitInterval)
+	}
+	return failed
+}
+
+// finish downloads the file if its job is done and puts back its modification
+// time and permissions.
+func (f restoreFile) finish() (bool, error) {
+	desc, err := describeJob(svc, f.job.JobID)
+	if err != nil {
+		return false, err
+	}
+
+	if aws.StringValue(desc.StatusCode) == glacier.StatusCodeFailed {
+		if err := removePendingJob(f.job.JobID); err != nil {
+			return false, err
+		}
+		return false, fmt.Errorf("job %s failed | %s", f.job.JobID, aws.StringValue(desc.StatusMessage))
+	}
+	if !aws.BoolValue(desc.Completed) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(f.out), 0755); err != nil {
+		return false, err
+	}
+	if f.rec.Mode.IsDir() {
+		// directories were uploaded with --archive tar
+		if err := f.extract(desc); err != nil {
+			return false, err
+		}
+	} else if err := downloadArchive(svc, desc, f.out, nil); err != nil {
+		return false, err
+	}
+
+	if f.rec.Mode != 0 {
+		if err := os.Chmod(f.out, f.rec.Mode.Perm()); err != nil {
+			return false, err
+		}
+	}
+	if !f.rec.ModTime.IsZero() {
+		if err := os.Chtimes(f.out, f.rec.ModTime, f.rec.ModTime); err != nil {
+			return false, err
+		}
+	}
+
+	return true, removePendingJob(f.job.JobID)
+}
+
+// extract downloads a tar archive of a directory next to where it goes and
+// unpacks it there.
+func (f restoreFile) extract(job *glacier.JobDescription) error {
+	archive := filepath.Join(filepath.Dir(f.out), "."+filepath.Base(f.out)+".tar")
+	if err := downloadArchive(svc, job, archive, nil); err != nil {
+		return err
+	}
+
+	r, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := extractTar(r, f.out); err != nil {
+		return fmt.Errorf("extracting %s | %s", archive, err)
+	}
+	r.Close()
+	return os.Remove(archive)
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreFiles(t *testing.T) {
+	home, err := ioutil.TempDir("", "glacier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	oldVault, oldRegion := vault, region
+	defer func() { vault, region = oldVault, oldRegion }()
+	vault, region = "photos", "us-east-1"
+	for i, fp := range []string{"/home/u/pics/a.jpg", "/home/u/pics/2019/b.jpg", "/home/u/pictures/c.jpg", "/home/u/pics/a.jpg"} {
+		rec := catalogRecord{Vault: vault, Region: region, ArchiveID: string(rune('0' + i)), Path: fp}
+		if err := appendCatalog(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := appendCatalog(catalogRecord{Vault: "other", Region: region, ArchiveID: "x", Path: "/home/u/pics/d.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]map[string]string{
+		"/home/u/pics/": {
+			filepath.Join("out", "a.jpg"):         "3",
+			filepath.Join("out", "2019", "b.jpg"): "1",
+		},
+		"/home/u/pics": {
+			filepath.Join("out", "pics", "a.jpg"):         "3",
+			filepath.Join("out", "pics", "2019", "b.jpg"): "1",
+		},
+	}
+
+	for prefix, expected := range tests {
+		files, err := restoreFiles(prefix, "out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != len(expected) {
+			t.Errorf("restoreFiles(%q) found %d file(s), expected %d", prefix, len(files), len(expected))
+		}
+		for _, f := range files {
+			if id, ok := expected[f.out]; !ok || id != f.rec.ArchiveID {
+				t.Errorf("restoreFiles(%q) restores archive %s to %s", prefix, f.rec.ArchiveID, f.out)
+			}
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/spf13/cobra"
+)
+
+var (
+	archiveID      string
+	tier           string
+	retrieveOutput string
+	retrieveRange  string
+	estimate       bool
+)
+
+var tiers = []string{"Expedited", "Standard", "Bulk"}
+
+var retrieveCmd = &cobra.Command{
+	Use:   "retrieve",
+	Short: "Retrieve an archive from a vault",
+	Long: `Archives take minutes (Expedited), hours (Standard) or up to half a day (Bulk)
+to be made available. The job is remembered locally, so running the same
+command again picks it up instead of starting another one. Once the job is
+done the archive is downloaded, then decompressed and decrypted if it was
+uploaded that way.
+
+With --range only part of the archive is retrieved, widened to whole megabytes
+as Glacier requires and trimmed back once downloaded. The bytes are saved as
+they're stored in Glacier, so a slice of a compressed or encrypted archive
+stays that way.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !validTier(tier) {
+			return fmt.Errorf("invalid tier: %s (want one of %s)", tier, strings.Join(tiers, ", "))
+		}
+
+		if concurrency < 1 {
+			return fmt.Errorf("invalid concurrency: must be at least 1")
+		}
+		budget = newRequestBudget(concurrency)
+
+		if waitInterval <= 0 {
+			return fmt.Errorf("invalid interval: must be more than 0")
+		}
+
+		var err error
+		kmsSvc, err = newKMS(cmd)
+		if err != nil {
+			return err
+		}
+
+		var requested *byteRange
+		if retrieveRange != "" {
+			r, err := parseByteRange(retrieveRange)
+			if err != nil {
+				return err
+			}
+			requested = &r
+		}
+
+		if estimate {
+			// every tier unless one was asked for
+			var only string
+			if cmd.Flags().Changed("tier") {
+				only = tier
+			}
+			return estimateArchive(requested, only)
+		}
+
+		job, err := retrievalJob(archiveID, requested, retrieveOutput)
+		if err != nil {
+			return err
+		}
+
+		var desc *glacier.JobDescription
+		if wait {
+			desc, err = waitForJob(svc, job.JobID, waitInterval, waitTimeout)
+		} else {
+			desc, err = describeJob(svc, job.JobID)
+		}
+		if err != nil {
+			return err
+		}
+
+		if aws.StringValue(desc.StatusCode) == glacier.StatusCodeFailed {
+			if err := removePendingJob(job.JobID); err != nil {
+				return err
+			}
+			return fmt.Errorf("job %s failed | %s", job.JobID, aws.StringValue(desc.StatusMessage))
+		}
+
+		if !aws.BoolValue(desc.Completed) {
+			fmt.Printf("Job %s is %s, run this again (or with --wait) to download the archive once it's done\n", job.JobID, aws.StringValue(desc.StatusCode))
+			return nil
+		}
+
+		out := retrieveOutput
+		if out == "" {
+			out = job.Output
+		}
+		if err := downloadArchive(svc, desc, out, requested); err != nil {
+			return err
+		}
+		return removePendingJob(job.JobID)
+	},
+}
+
+func init() {
+	retrieveCmd.Flags().StringVarP(&vault, "vault", "v", "", "Vault name")
+	err := retrieveCmd.MarkFlagRequired("vault")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	retrieveCmd.Flags().StringVarP(&archiveID, "archive-id", "a", "", "ID of the archive to retrieve")
+	err = retrieveCmd.MarkFlagRequired("archive-id")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	retrieveCmd.Flags().StringVar(&tier, "tier", "Standard", "Retrieval tier (Expedited, Standard, Bulk)")
+	retrieveCmd.Flags().StringVar(&retrieveRange, "range", "", "Only retrieve these bytes of the archive, e.g. 0-1048575 (inclusive)")
+	retrieveCmd.Flags().BoolVar(&estimate, "estimate", false, "Show what the retrieval would cost and how long it'd take instead of starting it")
+	retrieveCmd.Flags().StringVarP(&retrieveOutput, "output", "o", "", "Where to save the archive (defaults to its name in the current directory)")
+	retrieveCmd.Flags().StringVarP(&sns, "sns", "s", "", "SNS topic to notify when the archive is ready")
+	retrieveCmd.Flags().BoolVarP(&wait, "wait", "w", false, "Wait for the archive to be ready and download it")
+	retrieveCmd.Flags().DurationVar(&waitInterval, "interval", 15*time.Minute, "How often to check on the job while waiting")
+	retrieveCmd.Flags().DurationVar(&waitTimeout, "timeout", 24*time.Hour, "How long to wait before giving up (0 waits forever)")
+	retrieveCmd.Flags().StringVar(&keyFile, "key-file", "", "Key file the archive was encrypted with")
+	retrieveCmd.Flags().StringVar(&passphraseFile, "passphrase-file", "", "File holding the passphrase the archive was encrypted with (also read from $"+passphraseEnv+" or prompted for)")
+	retrieveCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 4, "Number of chunks to download at once")
+	retrieveCmd.Flags().IntVar(&maxAttempts, "max-attempts", 5, "Maximum number of times to try each request")
+}
+
+// retrievalJob picks up the job already retrieving the archive (or the
+// requested range of it), or starts one. output is remembered with the job.
+func retrievalJob(id string, requested *byteRange, output string) (*pendingJob, error) {
+	var rangeKey string
+	if requested != nil {
+		rangeKey = requested.String()
+	}
+
+	job, err := findPendingJob(vault, region, id, rangeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if job != nil {
+		_, err := lookupJob(svc, job.JobID)
+		if err == nil {
+			fmt.Printf("Picking up job %s started %s\n", job.JobID, job.InitiatedAt.Local().Format(time.RFC1123))
+			return job, nil
+		}
+
+		// job output expires a day after the job completes
+		if !isNotFound(err) {
+			return nil, formatAWSError(err)
+		}
+		fmt.Printf("Job %s has expired, starting a new one\n", job.JobID)
+		if err := removePendingJob(job.JobID); err != nil {
+			return nil, err
+		}
+	}
+
+	params := &glacier.JobParameters{
+		ArchiveId:   aws.String(id),
+		Description: aws.String("glacier retrieve"),
+		Tier:        aws.String(tier),
+		Type:        aws.String("archive-retrieval"),
+	}
+	if sns != "" {
+		params.SNSTopic = aws.String(sns)
+	}
+	if requested != nil {
+		size, err := archiveSize(region, vault, id)
+		if err != nil {
+			return nil, err
+		}
+
+		aligned, err := requested.align(size)
+		if err != nil {
+			return nil, err
+		}
+		params.RetrievalByteRange = aws.String(aligned.String())
+	}
+
+	result, err := svc.InitiateJob(&glacier.InitiateJobInput{
+		AccountId:     aws.String("-"),
+		JobParameters: params,
+		VaultName:     aws.String(vault),
+	})
+	if err != nil {
+		return nil, formatAWSError(err)
+	}
+
+	job = &pendingJob{
+		JobID:       *result.JobId,
+		Vault:       vault,
+		Region:      region,
+		ArchiveID:   id,
+		Tier:        tier,
+		Range:       rangeKey,
+		Output:      output,
+		InitiatedAt: time.Now().UTC(),
+	}
+	if err := addPendingJob(*job); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Started job %s\n", job.JobID)
+	return job, nil
+}
+
+// estimateArchive prints the cost of retrieving the archive (or the requested
+// range of it) with every tier, or just the given one.
+func estimateArchive(requested *byteRange, only string) error {
+	size, err := archiveSize(region, vault, archiveID)
+	if err != nil {
+		return err
+	}
+
+	if requested != nil {
+		aligned, err := requested.align(size)
+		if err != nil {
+			return err
+		}
+		size = aligned.end - aligned.start + 1
+	}
+	if size < 0 {
+		return fmt.Errorf("archive %s isn't in the catalog or inventory, run inventory first", archiveID)
+	}
+
+	estimates, err := estimateTiers([]int64{size}, only)
+	if err != nil {
+		return err
+	}
+	return printEstimates(estimates, "table")
+}
+
+func validTier(t string) bool {
+	for _, valid := range tiers {
+		if t == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadArchive downloads a finished retrieval job and undoes whatever was
+// done to the archive on upload, or trims it to the requested range. An empty
+// out saves it under the archive's name.
+func downloadArchive(svc *glacier.Glacier, job *glacier.JobDescription, out string, requested *byteRange) error {
+	dir := "."
+	if out != "" {
+		dir = filepath.Dir(out)
+	}
+	raw := filepath.Join(dir, fmt.Sprintf(".%s.download", aws.StringValue(job.JobId)))
+
+	desc, err := downloadJobOutput(svc, job, raw)
+	if err != nil {
+		return err
+	}
+
+	m := parseDescription(desc)
+	if out == "" {
+		out = filepath.Base(m.Name)
+		if out == "." || out == string(filepath.Separator) || out == "" {
+			out = aws.StringValue(job.ArchiveId)
+		}
+		if requested != nil {
+			out += "." + requested.String()
+		}
+	}
+
+	if requested != nil {
+		err = trimFile(raw, out, *requested, aws.StringValue(job.RetrievalByteRange))
+	} else {
+		err = decodeFile(raw, out, m)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved %s\n", out)
+	return nil
+}
+
+// decodeFile turns a downloaded archive into the file that was uploaded,
+// replacing out.
+func decodeFile(raw string, out string, m archiveMetadata) error {
+	if m.Compress == "" && m.Encrypt == "" {
+		return os.Rename(raw, out)
+	}
+
+	if m.Encrypt != "" && m.KMSKey == "" && keys == nil {
+		var err error
+		keys, err = loadKeySource(keyFile, passphraseFile, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	in, err := os.Open(raw)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r, err := decodeArchive(in, m, keys, kmsSvc)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileFrom(out, r); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(raw)
+}
+
+// trimFile cuts the requested bytes out of a downloaded range of an archive,
+// which was widened to retrieved ("start-end") when the job was started.
+func trimFile(raw string, out string, requested byteRange, retrieved string) error {
+	aligned, err := parseByteRange(retrieved)
+	if err != nil {
+		return fmt.Errorf("job retrieved an unexpected range | %s", err)
+	}
+	if requested.start < aligned.start || requested.end > aligned.end {
+		return fmt.Errorf("job retrieved bytes %s, which doesn't cover %s", aligned, requested)
+	}
+
+	in, err := os.Open(raw)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r := io.NewSectionReader(in, requested.start-aligned.start, requested.end-requested.start+1)
+	if err := writeFileFrom(out, r); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(raw)
+}
+
+// writeFileFrom writes r to a temporary file and renames it over fp.
+func writeFileFrom(fp string, r io.Reader) error {
+	tmp := fp + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
+
+// byteRange is an inclusive range of bytes in an archive.
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// parseByteRange parses "start-end".
+func parseByteRange(s string) (byteRange, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return byteRange{}, fmt.Errorf("invalid range %q: expected start-end", s)
+	}
+
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return byteRange{}, fmt.Errorf("invalid range %q: %s", s, err)
+	}
+	end, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil {
+		return byteRange{}, fmt.Errorf("invalid range %q: %s", s, err)
+	}
+	if start < 0 || end < start {
+		return byteRange{}, fmt.Errorf("invalid range %q: end comes before start", s)
+	}
+	return byteRange{start, end}, nil
+}
+
+func (r byteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.start, r.end)
+}
+
+// align widens the range to whole megabytes, which Glacier requires of every
+// range except one that runs to the end of the archive. Glacier only gives the
+// job a tree hash to check against when the range is also tree-hash aligned.
+// size is the size of the archive, or -1 if it isn't known.
+func (r byteRange) align(size int64) (byteRange, error) {
+	if size >= 0 && r.end >= size {
+		return byteRange{}, fmt.Errorf("range %s is past the end of the archive (%d bytes)", r, size)
+	}
+
+	aligned := byteRange{
+		start: r.start / minPartSize * minPartSize,
+		end:   (r.end/minPartSize+1)*minPartSize - 1,
+	}
+	if size >= 0 && aligned.end >= size {
+		aligned.end = size - 1
+	}
+	if size < 0 && aligned.end != r.end {
+		return byteRange{}, fmt.Errorf("can't tell whether range %s runs to the end of the archive, end it one byte before a multiple of 1MiB or run inventory first", r)
+	}
+	return aligned, nil
+}
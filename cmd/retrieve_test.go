@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+// testGlacier points a Glacier client at a local handler.
+func testGlacier(handler http.Handler) (*glacier.Glacier, func()) {
+	server := httptest.NewServer(handler)
+	svc := glacier.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})))
+	return svc, server.Close
+}
+
+func TestRetrievalJobExpired(t *testing.T) {
+	home, err := ioutil.TempDir("", "glacier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	oldVault, oldRegion, oldTier, oldSvc, oldAttempts := vault, region, tier, svc, maxAttempts
+	defer func() { vault, region, tier, svc, maxAttempts = oldVault, oldRegion, oldTier, oldSvc, oldAttempts }()
+	vault, region, tier, maxAttempts = "photos", "us-east-1", "Standard", 1
+
+	var started int
+	var closeServer func()
+	svc, closeServer = testGlacier(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/jobs/old"):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"ResourceNotFoundException","message":"The job ID was not found: old"}`))
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/jobs"):
+			started++
+			w.Header().Set("x-amz-job-id", "new")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer closeServer()
+
+	if err := addPendingJob(pendingJob{JobID: "old", Vault: vault, Region: region, ArchiveID: "a", InitiatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := retrievalJob("a", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.JobID != "new" || started != 1 {
+		t.Errorf("an expired job should be replaced, got job %s after starting %d", job.JobID, started)
+	}
+
+	jobs, err := loadPendingJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].JobID != "new" {
+		t.Errorf("pending jobs = %v, expected only the new one", jobs)
+	}
+}
+
+func TestAlignRange(t *testing.T) {
+	tests := []struct {
+		r        string
+		size     int64
+		expected string
+	}{
+		{"0-1048575", -1, "0-1048575"},
+		{"100-200", 10 << 20, "0-1048575"},
+		{"1048577-3145727", -1, "1048576-3145727"},
+		{"5000000-5000100", 5000200, "4194304-5000199"},
+	}
+
+	for _, test := range tests {
+		r, err := parseByteRange(test.r)
+		if err != nil {
+			t.Errorf("parseByteRange(%q) failed | %s", test.r, err)
+			continue
+		}
+
+		aligned, err := r.align(test.size)
+		if err != nil {
+			t.Errorf("%s.align(%d) failed | %s", test.r, test.size, err)
+			continue
+		}
+		if aligned.String() != test.expected {
+			t.Errorf("%s.align(%d) = %s, expected %s", test.r, test.size, aligned, test.expected)
+		}
+	}
+
+	for _, s := range []string{"", "5", "10-5", "-1-5", "a-b"} {
+		if _, err := parseByteRange(s); err == nil {
+			t.Errorf("parseByteRange(%q) should have failed", s)
+		}
+	}
+
+	r, _ := parseByteRange("100-200")
+	if _, err := r.align(-1); err == nil {
+		t.Errorf("aligning an unaligned end without the archive size should have failed")
+	}
+	if _, err := r.align(150); err == nil {
+		t.Errorf("aligning past the end of the archive should have failed")
+	}
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+const (
+	baseRetryDelay = 500 * time.Millisecond
+	maxRetryDelay  = 30 * time.Second
+)
+
+var maxAttempts int
+
+// errCodeRequestError is the code the SDK gives network errors, which it always
+// retries. This version of the SDK doesn't export it.
+const errCodeRequestError = "RequestError"
+
+// withRetries calls fn until it succeeds, fails with an error that isn't worth
+// retrying, or has been attempted maxAttempts times. The last error is returned.
+// Requests made in fn should pass noSDKRetries so that maxAttempts is the real
+// cap instead of being multiplied by the SDK's own retries.
+func withRetries(maxAttempts int, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= maxAttempts || !isRetryable(err) {
+			return err
+		}
+
+		time.Sleep(backoff(attempt))
+	}
+}
+
+// noSDKRetries turns off the SDK's default retryer (3 retries) for a request
+// that withRetries is already retrying.
+func noSDKRetries(r *request.Request) {
+	r.Retryer = client.DefaultRetryer{NumMaxRetries: 0}
+}
+
+// isRetryable covers timeouts, throttling and network errors (which the SDK
+// reports as RequestError).
+func isRetryable(err error) bool {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return true
+	}
+
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case glacier.ErrCodeRequestTimeoutException, glacier.ErrCodeServiceUnavailableException:
+			return true
+		}
+	}
+	return false
+}
+
+// backoff doubles the delay with every attempt and picks a random point in the
+// upper half of it so that workers don't retry in lockstep.
+func backoff(attempt int) time.Duration {
+	d := maxRetryDelay
+	if attempt < 16 {
+		if exp := baseRetryDelay << uint(attempt-1); exp < maxRetryDelay {
+			d = exp
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
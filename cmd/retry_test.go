@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{awserr.New(errCodeRequestError, "connection reset", nil), true},
+		{awserr.New("Throttling", "slow down", nil), true},
+		{awserr.New("ThrottlingException", "slow down", nil), true},
+		{awserr.New(glacier.ErrCodeRequestTimeoutException, "timed out", nil), true},
+		{awserr.New(glacier.ErrCodeServiceUnavailableException, "unavailable", nil), true},
+		{awserr.New(glacier.ErrCodeResourceNotFoundException, "no such vault", nil), false},
+		{awserr.New(glacier.ErrCodeInvalidParameterValueException, "bad range", nil), false},
+		{awserr.New(glacier.ErrCodeMissingParameterValueException, "no vault", nil), false},
+		{errors.New("not from aws"), false},
+	}
+
+	for _, test := range tests {
+		if actual := isRetryable(test.err); actual != test.expected {
+			t.Errorf("isRetryable(%v) = %v, expected %v", test.err, actual, test.expected)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, baseRetryDelay},
+		{2, 2 * baseRetryDelay},
+		{3, 4 * baseRetryDelay},
+		{7, maxRetryDelay},
+		{100, maxRetryDelay},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if d := backoff(test.attempt); d < test.max/2 || d >= test.max {
+				t.Errorf("backoff(%d) = %s, expected [%s, %s)", test.attempt, d, test.max/2, test.max)
+				break
+			}
+		}
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		maxAttempts int
+		expected    int
+	}{
+		{"success", nil, 3, 1},
+		{"retryable", awserr.New(glacier.ErrCodeServiceUnavailableException, "unavailable", nil), 2, 2},
+		{"not retryable", awserr.New(glacier.ErrCodeResourceNotFoundException, "no such vault", nil), 3, 1},
+		{"one attempt", awserr.New(glacier.ErrCodeServiceUnavailableException, "unavailable", nil), 1, 1},
+	}
+
+	for _, test := range tests {
+		var calls int
+		err := withRetries(test.maxAttempts, func() error {
+			calls++
+			return test.err
+		})
+		if err != test.err {
+			t.Errorf("%s: withRetries = %v, expected %v", test.name, err, test.err)
+		}
+		if calls != test.expected {
+			t.Errorf("%s: fn called %d time(s), expected %d", test.name, calls, test.expected)
+		}
+	}
+}
+
+func TestNoSDKRetries(t *testing.T) {
+	var requests int
+	svc, closeServer := testGlacier(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"code":"ServiceUnavailableException","message":"unavailable"}`))
+	}))
+	defer closeServer()
+
+	// without noSDKRetries the SDK would send each attempt 4 times
+	err := withRetries(2, func() error {
+		_, err := svc.DescribeVaultWithContext(aws.BackgroundContext(), &glacier.DescribeVaultInput{
+			AccountId: aws.String("-"),
+			VaultName: aws.String("photos"),
+		}, noSDKRetries)
+		return err
+	})
+	if err == nil {
+		t.Fatal("expected an error from DescribeVault")
+	}
+	if requests != 2 {
+		t.Errorf("sent %d request(s), expected 2", requests)
+	}
+}
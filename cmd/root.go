@@ -7,6 +7,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/spf13/cobra"
 	"github.com/spf13/cobra/doc"
 )
@@ -15,6 +16,7 @@ import (
 var (
 	region string
 	vault  string
+	sess   *session.Session
 	svc    *glacier.Glacier
 )
 
@@ -30,12 +32,12 @@ the profile you want to use with the --profile flag.`,
 			return err
 		}
 
-		region, err := cmd.Flags().GetString("region")
+		region, err = cmd.Flags().GetString("region")
 		if err != nil {
 			return err
 		}
 
-		sess, err := session.NewSession(&aws.Config{
+		sess, err = session.NewSession(&aws.Config{
 			Region:      aws.String(region),
 			Credentials: credentials.NewSharedCredentials("", profile),
 		})
@@ -68,10 +70,32 @@ var genDocsCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(
 		inventoryCmd,
+		costCmd,
+		jobsCmd,
+		listCmd,
+		restoreCmd,
+		retrieveCmd,
+		selectCmd,
 		uploadCmd,
+		vaultCmd,
 		genDocsCmd,
 	)
 
 	RootCmd.PersistentFlags().String("profile", "default", "AWS credentials profile to use")
 	RootCmd.PersistentFlags().String("region", "us-east-1", "AWS region of the vault")
+	RootCmd.PersistentFlags().String("kms-endpoint", "", "KMS endpoint to use instead of AWS's, e.g. a local KMS for testing")
+}
+
+// newKMS connects to KMS with the same credentials and region as Glacier.
+func newKMS(cmd *cobra.Command) (*kms.KMS, error) {
+	endpoint, err := cmd.Flags().GetString("kms-endpoint")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := aws.NewConfig()
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	return kms.New(sess, cfg), nil
 }
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/spf13/cobra"
+)
+
+var (
+	selectExpression string
+	selectS3Output   string
+
+	csvHeader          string
+	csvComments        string
+	csvFieldDelimiter  string
+	csvRecordDelimiter string
+	csvQuote           string
+	csvQuoteEscape     string
+
+	csvOutFieldDelimiter  string
+	csvOutRecordDelimiter string
+	csvOutQuoteFields     string
+
+	s3StorageClass string
+	s3ACL          string
+	s3Encryption   string
+	s3KMSKeyID     string
+)
+
+var selectCmd = &cobra.Command{
+	Use:   "select",
+	Short: "Run a SQL query over a CSV archive",
+	Long: `Starts a select job, which runs the query over the archive in place and writes
+the results to S3, under the given prefix and the job's ID. The archive has to
+be uncompressed, unencrypted CSV. Use the jobs command (or --wait) to follow
+the job.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !validTier(tier) {
+			return fmt.Errorf("invalid tier: %s (want one of %s)", tier, strings.Join(tiers, ", "))
+		}
+
+		if waitInterval <= 0 {
+			return fmt.Errorf("invalid interval: must be more than 0")
+		}
+
+		params, err := selectParameters()
+		if err != nil {
+			return err
+		}
+
+		location, err := s3OutputLocation(selectS3Output)
+		if err != nil {
+			return err
+		}
+
+		input := &glacier.InitiateJobInput{
+			AccountId: aws.String("-"),
+			JobParameters: &glacier.JobParameters{
+				ArchiveId:        aws.String(archiveID),
+				Description:      aws.String("glacier select"),
+				OutputLocation:   location,
+				SelectParameters: params,
+				Tier:             aws.String(tier),
+				Type:             aws.String("select"),
+			},
+			VaultName: aws.String(vault),
+		}
+		if sns != "" {
+			input.JobParameters.SNSTopic = aws.String(sns)
+		}
+
+		result, err := svc.InitiateJob(input)
+		if err != nil {
+			return formatAWSError(err)
+		}
+		jobID := aws.StringValue(result.JobId)
+		fmt.Printf("Started select job %s\n", jobID)
+
+		if !wait {
+			fmt.Printf("Results will be written to %s, follow the job with: glacier jobs wait %s --vault %s\n", selectResults(location.S3, jobID), jobID, vault)
+			return nil
+		}
+
+		if _, err := waitForJob(svc, jobID, waitInterval, waitTimeout); err != nil {
+			return err
+		}
+		fmt.Printf("Results are in %s\n", selectResults(location.S3, jobID))
+		return nil
+	},
+}
+
+func init() {
+	selectCmd.Flags().StringVarP(&vault, "vault", "v", "", "Vault name")
+	err := selectCmd.MarkFlagRequired("vault")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectCmd.Flags().StringVarP(&archiveID, "archive-id", "a", "", "ID of the archive to query")
+	err = selectCmd.MarkFlagRequired("archive-id")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectCmd.Flags().StringVarP(&selectExpression, "expression", "e", "", "SQL query to run, e.g. \"SELECT s._1 FROM archive s\"")
+	err = selectCmd.MarkFlagRequired("expression")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectCmd.Flags().StringVar(&selectS3Output, "s3-output", "", "Where to write the results, as s3://bucket/prefix")
+	err = selectCmd.MarkFlagRequired("s3-output")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectCmd.Flags().StringVar(&tier, "tier", "Standard", "Retrieval tier (Expedited, Standard, Bulk)")
+
+	selectCmd.Flags().StringVar(&csvHeader, "csv-header", glacier.FileHeaderInfoNone, "What the first line of the archive is (USE it for column names, IGNORE it, or NONE if it's data)")
+	selectCmd.Flags().StringVar(&csvComments, "csv-comments", "", "Skip lines starting with this character")
+	selectCmd.Flags().StringVar(&csvFieldDelimiter, "csv-field-delimiter", "", "Field delimiter of the archive (default ,)")
+	selectCmd.Flags().StringVar(&csvRecordDelimiter, "csv-record-delimiter", "", "Record delimiter of the archive (default \\n)")
+	selectCmd.Flags().StringVar(&csvQuote, "csv-quote", "", "Quote character of the archive (default \")")
+	selectCmd.Flags().StringVar(&csvQuoteEscape, "csv-quote-escape", "", "Character that escapes a quote inside a quoted field")
+
+	selectCmd.Flags().StringVar(&csvOutFieldDelimiter, "output-field-delimiter", "", "Field delimiter of the results (default ,)")
+	selectCmd.Flags().StringVar(&csvOutRecordDelimiter, "output-record-delimiter", "", "Record delimiter of the results (default \\n)")
+	selectCmd.Flags().StringVar(&csvOutQuoteFields, "output-quote-fields", "", "Quote every field of the results (ALWAYS) or only when needed (ASNEEDED)")
+
+	selectCmd.Flags().StringVar(&s3StorageClass, "s3-storage-class", "", "Storage class of the results (STANDARD, REDUCED_REDUNDANCY, STANDARD_IA)")
+	selectCmd.Flags().StringVar(&s3ACL, "s3-acl", "", "Canned ACL for the results, e.g. bucket-owner-full-control")
+	selectCmd.Flags().StringVar(&s3Encryption, "s3-encryption", "", "Server side encryption of the results (AES256, aws:kms)")
+	selectCmd.Flags().StringVar(&s3KMSKeyID, "s3-kms-key-id", "", "KMS key to encrypt the results with (implies --s3-encryption aws:kms)")
+
+	selectCmd.Flags().StringVarP(&sns, "sns", "s", "", "SNS topic to notify when the job is done")
+	selectCmd.Flags().BoolVarP(&wait, "wait", "w", false, "Wait for the job to finish")
+	selectCmd.Flags().DurationVar(&waitInterval, "interval", 15*time.Minute, "How often to check on the job while waiting")
+	selectCmd.Flags().DurationVar(&waitTimeout, "timeout", 24*time.Hour, "How long to wait before giving up (0 waits forever)")
+}
+
+// selectParameters builds the query and how the CSV going in and coming out is
+// laid out from the flags.
+func selectParameters() (*glacier.SelectParameters, error) {
+	in := &glacier.CSVInput{}
+	switch strings.ToUpper(csvHeader) {
+	case glacier.FileHeaderInfoUse, glacier.FileHeaderInfoIgnore, glacier.FileHeaderInfoNone:
+		in.FileHeaderInfo = aws.String(strings.ToUpper(csvHeader))
+	default:
+		return nil, fmt.Errorf("invalid csv header: %s (want USE, IGNORE or NONE)", csvHeader)
+	}
+	setString(&in.Comments, csvComments)
+	setString(&in.FieldDelimiter, csvFieldDelimiter)
+	setString(&in.RecordDelimiter, csvRecordDelimiter)
+	setString(&in.QuoteCharacter, csvQuote)
+	setString(&in.QuoteEscapeCharacter, csvQuoteEscape)
+
+	out := &glacier.CSVOutput{}
+	switch strings.ToUpper(csvOutQuoteFields) {
+	case "":
+	case glacier.QuoteFieldsAlways, glacier.QuoteFieldsAsneeded:
+		out.QuoteFields = aws.String(strings.ToUpper(csvOutQuoteFields))
+	default:
+		return nil, fmt.Errorf("invalid output quote fields: %s (want ALWAYS or ASNEEDED)", csvOutQuoteFields)
+	}
+	setString(&out.FieldDelimiter, csvOutFieldDelimiter)
+	setString(&out.RecordDelimiter, csvOutRecordDelimiter)
+
+	return &glacier.SelectParameters{
+		Expression:          aws.String(selectExpression),
+		ExpressionType:      aws.String(glacier.ExpressionTypeSql),
+		InputSerialization:  &glacier.InputSerialization{Csv: in},
+		OutputSerialization: &glacier.OutputSerialization{Csv: out},
+	}, nil
+}
+
+// s3OutputLocation parses s3://bucket/prefix and adds the S3 flags to it.
+func s3OutputLocation(url string) (*glacier.OutputLocation, error) {
+	if !strings.HasPrefix(url, "s3://") {
+		return nil, fmt.Errorf("invalid S3 location: %s (expected s3://bucket/prefix)", url)
+	}
+
+	// Glacier needs both
+	parts := strings.SplitN(strings.TrimPrefix(url, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid S3 location: %s (expected s3://bucket/prefix)", url)
+	}
+
+	loc := &glacier.S3Location{
+		BucketName: aws.String(parts[0]),
+		Prefix:     aws.String(parts[1]),
+	}
+	setString(&loc.StorageClass, s3StorageClass)
+	setString(&loc.CannedACL, s3ACL)
+
+	if s3KMSKeyID != "" && s3Encryption == "" {
+		s3Encryption = "aws:kms"
+	}
+	if s3Encryption != "" {
+		loc.Encryption = &glacier.Encryption{EncryptionType: aws.String(s3Encryption)}
+		setString(&loc.Encryption.KMSKeyId, s3KMSKeyID)
+	}
+
+	return &glacier.OutputLocation{S3: loc}, nil
+}
+
+// selectResults is where a select job writes its results.
+func selectResults(loc *glacier.S3Location, jobID string) string {
+	prefix := strings.TrimSuffix(aws.StringValue(loc.Prefix), "/")
+	return fmt.Sprintf("s3://%s/%s/%s/", aws.StringValue(loc.BucketName), prefix, jobID)
+}
+
+// setString sets an optional SDK field only if there's a value for it.
+func setString(field **string, value string) {
+	if value != "" {
+		*field = aws.String(value)
+	}
+}
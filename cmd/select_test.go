@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestS3OutputLocation(t *testing.T) {
+	s3KMSKeyID = "alias/results"
+	defer func() { s3KMSKeyID, s3Encryption = "", "" }()
+
+	loc, err := s3OutputLocation("s3://bucket/select/results/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(loc.S3.BucketName) != "bucket" || aws.StringValue(loc.S3.Prefix) != "select/results/" {
+		t.Errorf("s3://bucket/select/results/ parsed as bucket %s, prefix %s", aws.StringValue(loc.S3.BucketName), aws.StringValue(loc.S3.Prefix))
+	}
+	if loc.S3.Encryption == nil || aws.StringValue(loc.S3.Encryption.EncryptionType) != "aws:kms" {
+		t.Errorf("a KMS key should encrypt the results with aws:kms")
+	}
+
+	if url := selectResults(loc.S3, "job"); url != "s3://bucket/select/results/job/" {
+		t.Errorf("selectResults = %s, expected s3://bucket/select/results/job/", url)
+	}
+
+	for _, url := range []string{"bucket/prefix", "s3://", "s3://bucket", "s3://bucket/", "s3:///prefix"} {
+		if _, err := s3OutputLocation(url); err == nil {
+			t.Errorf("s3OutputLocation(%q) should have failed", url)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tarStream returns the tree rooted at root as a tar archive, written on the fly
+// as it's read. Closing the reader stops the walk.
+func tarStream(root string) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(pw, root))
+	}()
+	return pr
+}
+
+// writeTar writes every file, directory and symlink under root to w, named
+// relative to root. root has to be a directory.
+func writeTar(w io.Writer, root string) error {
+	stats, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !stats.IsDir() {
+		return fmt.Errorf("%s isn't a directory", root)
+	}
+
+	tw := tar.NewWriter(w)
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// extractTar writes the files, directories and symlinks in a tar archive under
+// dest, with their modes and modification times. Symlinks are made after every
+// file, so that a later entry can't be written through one to somewhere outside
+// dest. Directories are finished last so that writing into them doesn't change
+// their times, or fail on read-only ones.
+func extractTar(r io.Reader, dest string) error {
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return err
+	}
+
+	type entry struct {
+		name string
+		hdr  *tar.Header
+	}
+	var dirs, links []entry
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid tar entry: %s is outside the archive", hdr.Name)
+		}
+		fp := filepath.Join(dest, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := checkSymlinks(dest, name, hdr); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(fp, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, entry{name, hdr})
+		case tar.TypeReg:
+			if err := checkSymlinks(dest, filepath.Dir(name), hdr); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(fp), 0700); err != nil {
+				return err
+			}
+			if err := writeFileFrom(fp, tr); err != nil {
+				return err
+			}
+			if err := os.Chmod(fp, os.FileMode(hdr.Mode).Perm()); err != nil {
+				return err
+			}
+			if err := os.Chtimes(fp, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			links = append(links, entry{name, hdr})
+		default:
+			fmt.Printf("Skipping %s, unsupported file type\n", hdr.Name)
+		}
+	}
+
+	for _, l := range links {
+		if err := checkSymlinks(dest, filepath.Dir(l.name), l.hdr); err != nil {
+			return err
+		}
+		fp := filepath.Join(dest, l.name)
+		if err := os.MkdirAll(filepath.Dir(fp), 0700); err != nil {
+			return err
+		}
+		// removing a directory here would leave the chmod below to follow the link
+		if info, err := os.Lstat(fp); err == nil && info.IsDir() {
+			return fmt.Errorf("invalid tar entry: %s is both a directory and a symlink", l.hdr.Name)
+		}
+		if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Symlink(l.hdr.Linkname, fp); err != nil {
+			return err
+		}
+	}
+
+	// deepest first, so a parent's time is set after its children's
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		fp := filepath.Join(dest, d.name)
+		if err := os.Chmod(fp, os.FileMode(d.hdr.Mode).Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(fp, d.hdr.ModTime, d.hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSymlinks fails if any directory on the path from dest to rel (rel
+// included) is a symlink, since writing hdr through it could land outside dest.
+func checkSymlinks(dest string, rel string, hdr *tar.Header) error {
+	path := dest
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("invalid tar entry: %s is under a symlink", hdr.Name)
+		}
+	}
+	return nil
+}
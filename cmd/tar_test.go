@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteTar(t *testing.T) {
+	root, err := ioutil.TempDir("", "glacier-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "b", "c.txt"), []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2017, 12, 1, 10, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "a", "b", "c.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeTar(&buf, root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a/", "a/b/", "a/b/c.txt"}
+	tr := tar.NewReader(&buf)
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if i != len(expected) {
+				t.Fatalf("expected %d entries, got %d", len(expected), i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(expected) || hdr.Name != expected[i] {
+			t.Fatalf("unexpected entry %s", hdr.Name)
+		}
+
+		if hdr.Name == "a/b/c.txt" {
+			if hdr.Mode&0777 != 0640 {
+				t.Errorf("expected mode 0640, got %o", hdr.Mode&0777)
+			}
+			if !hdr.ModTime.Equal(mtime) {
+				t.Errorf("expected mtime %s, got %s", mtime, hdr.ModTime)
+			}
+			b, _ := ioutil.ReadAll(tr)
+			if string(b) != "hello" {
+				t.Errorf("expected contents hello, got %s", b)
+			}
+		}
+	}
+}
+
+func TestWriteTarFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "glacier-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	var buf bytes.Buffer
+	if err := writeTar(&buf, f.Name()); err == nil {
+		t.Error("expected an error for a file that isn't a directory")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %d bytes, expected nothing", buf.Len())
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	root, err := ioutil.TempDir("", "glacier-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src := filepath.Join(root, "src")
+	if err := os.MkdirAll(filepath.Join(src, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a", "b", "c.txt"), []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b/c.txt", filepath.Join(src, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2017, 12, 1, 10, 0, 0, 0, time.UTC)
+	for _, fp := range []string{filepath.Join(src, "a", "b", "c.txt"), filepath.Join(src, "a", "b"), filepath.Join(src, "a")} {
+		if err := os.Chtimes(fp, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "a", "b"), 0550); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(src, "a", "b"), 0755)
+
+	var buf bytes.Buffer
+	if err := writeTar(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(root, "dest")
+	if err := extractTar(&buf, dest); err != nil {
+		t.Fatalf("extractTar failed | %s", err)
+	}
+	defer os.Chmod(filepath.Join(dest, "a", "b"), 0755)
+
+	b, err := ioutil.ReadFile(filepath.Join(dest, "a", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("contents = %s, expected hello", b)
+	}
+
+	for fp, mode := range map[string]os.FileMode{"a/b/c.txt": 0640, "a/b": 0550, "a": 0755} {
+		stats, err := os.Stat(filepath.Join(dest, fp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Mode().Perm() != mode {
+			t.Errorf("%s mode = %o, expected %o", fp, stats.Mode().Perm(), mode)
+		}
+		if !stats.ModTime().Equal(mtime) {
+			t.Errorf("%s mtime = %s, expected %s", fp, stats.ModTime(), mtime)
+		}
+	}
+}
+
+func TestExtractTarOutside(t *testing.T) {
+	dest, err := ioutil.TempDir("", "glacier-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "a/../../evil", Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := extractTar(&buf, filepath.Join(dest, "out")); err == nil {
+		t.Error("expected an error for an entry outside the archive")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "evil")); !os.IsNotExist(err) {
+		t.Error("entry was written outside the archive")
+	}
+}
+
+func TestExtractTarThroughSymlink(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*tar.Header
+		// a symlink already in dest, pointing outside
+		existing string
+	}{
+		{
+			name: "file under a symlink",
+			entries: []*tar.Header{
+				{Name: "link", Typeflag: tar.TypeSymlink},
+				{Name: "link/evil", Mode: 0644, Typeflag: tar.TypeReg},
+			},
+		},
+		{
+			name: "symlink under a symlink",
+			entries: []*tar.Header{
+				{Name: "link", Typeflag: tar.TypeSymlink},
+				{Name: "link/evil", Linkname: "anywhere", Typeflag: tar.TypeSymlink},
+			},
+		},
+		{
+			name: "symlink over a directory",
+			entries: []*tar.Header{
+				{Name: "link/", Mode: 0700, Typeflag: tar.TypeDir},
+				{Name: "link", Typeflag: tar.TypeSymlink},
+			},
+		},
+		{
+			name:     "file under an existing symlink",
+			existing: "link",
+			entries: []*tar.Header{
+				{Name: "link/evil", Mode: 0644, Typeflag: tar.TypeReg},
+			},
+		},
+		{
+			name:     "directory on an existing symlink",
+			existing: "link",
+			entries: []*tar.Header{
+				{Name: "link/", Mode: 0777, Typeflag: tar.TypeDir},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		tmp, err := ioutil.TempDir("", "glacier-tar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		outside, dest := filepath.Join(tmp, "outside"), filepath.Join(tmp, "out")
+		if err := os.MkdirAll(outside, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(dest, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if test.existing != "" {
+			if err := os.Symlink(outside, filepath.Join(dest, test.existing)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range test.entries {
+			if hdr.Typeflag == tar.TypeSymlink && hdr.Linkname == "" {
+				hdr.Linkname = outside
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := extractTar(&buf, dest); err == nil {
+			t.Errorf("%s: expected an error for an entry written through a symlink", test.name)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+			t.Errorf("%s: entry was written outside the archive", test.name)
+		}
+		if info, err := os.Stat(outside); err != nil || info.Mode().Perm() != 0700 {
+			t.Errorf("%s: mode of the directory outside the archive was changed", test.name)
+		}
+		os.RemoveAll(tmp)
+	}
+}
@@ -1,49 +1,151 @@
 package cmd
 
 import (
-	"bytes"
-	"crypto/sha256"
+	"bufio"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/glacier"
-	"github.com/nickvanw/treehash"
+	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/spf13/cobra"
-	"gopkg.in/cheggaaa/pb.v2"
 )
 
-var target string
+var (
+	target         string
+	concurrency    int
+	resume         bool
+	resumeUploadID string
+	partSizeMiB    int64
+	thresholdMiB   int64
+	description    string
+	archiveFormat  string
+	compress       string
+	encrypt        bool
+	keyFile        string
+	passphraseFile string
+	keys           *keySource
+	kmsKeyID       string
+	kmsSvc         *kms.KMS
+	order          string
+	uploads        *progress
+)
 
 var uploadCmd = &cobra.Command{
 	Use:   "upload",
 	Short: "Upload a file or directory to Glacier",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if concurrency < 1 {
+			return fmt.Errorf("invalid concurrency: must be at least 1")
+		}
+		if maxAttempts < 1 {
+			return fmt.Errorf("invalid max attempts: must be at least 1")
+		}
+		// single requests are capped at the same size as parts
+		if thresholdMiB < 0 || thresholdMiB > maxPartSize>>20 {
+			return fmt.Errorf("invalid multipart threshold: %dMiB is not between 0MiB and %dMiB", thresholdMiB, maxPartSize>>20)
+		}
+
+		if compress != "" {
+			if _, err := lookupCodec(compress); err != nil {
+				return err
+			}
+		}
+		if encrypt && kmsKeyID != "" {
+			return fmt.Errorf("--encrypt and --kms-key-id can't be used together, --kms-key-id encrypts on its own")
+		}
+		switch {
+		case kmsKeyID != "":
+			var err error
+			kmsSvc, err = newKMS(cmd)
+			if err != nil {
+				return err
+			}
+		case encrypt:
+			var err error
+			keys, err = loadKeySource(keyFile, passphraseFile, true)
+			if err != nil {
+				return err
+			}
+		}
+		if transformed() && (resume || resumeUploadID != "") {
+			return fmt.Errorf("invalid target: compressed or encrypted uploads can't be resumed")
+		}
+
+		budget = newRequestBudget(concurrency)
+
+		if target == "-" {
+			if resume || resumeUploadID != "" {
+				return fmt.Errorf("invalid target: stdin uploads can't be resumed")
+			}
+
+			uploads = newProgress(1, 0)
+			defer uploads.stop()
+			return uploadReader(svc, os.Stdin, "stdin", "")
+		}
+
+		switch archiveFormat {
+		case "":
+		case "tar":
+			if resume || resumeUploadID != "" {
+				return fmt.Errorf("invalid target: tar uploads can't be resumed")
+			}
+			stats, err := os.Stat(target)
+			if err != nil {
+				return fmt.Errorf("invalid target: %s", err)
+			}
+			if !stats.IsDir() {
+				return fmt.Errorf("invalid target: %s isn't a directory, --archive tar bundles directories", target)
+			}
+			abs, err := filepath.Abs(target)
+			if err != nil {
+				return err
+			}
+
+			r := tarStream(target)
+			defer r.Close()
+
+			uploads = newProgress(1, 0)
+			defer uploads.stop()
+			return uploadReader(svc, r, abs+".tar", abs)
+		default:
+			return fmt.Errorf("invalid archive format: %s", archiveFormat)
+		}
+
 		files := make(map[string]struct{})
 		getFiles(target, files)
 		if len(files) == 0 {
 			return fmt.Errorf("invalid target: no file(s) found")
 		}
+		if resumeUploadID != "" && len(files) != 1 {
+			return fmt.Errorf("invalid target: --resume-upload-id needs a single file")
+		}
 
-		for fp := range files {
-			err := uploadFileMultipart(svc, fp)
-			if err != nil {
-				return err
-			}
+		sorted, totalSize, err := sortFiles(files, order)
+		if err != nil {
+			return err
+		}
+
+		// streamed archives don't end up the size of the files going into them
+		if transformed() {
+			totalSize = 0
 		}
 
-		return nil
+		uploads = newProgress(len(sorted), totalSize)
+		err = uploadFiles(svc, sorted)
+		uploads.stop()
+		return err
 	},
 }
 
 func init() {
-	uploadCmd.Flags().StringVarP(&target, "target", "t", "", "Path to file or directory to upload")
+	uploadCmd.Flags().StringVarP(&target, "target", "t", "", "Path to file or directory to upload, or - to read from stdin")
 	err := uploadCmd.MarkFlagRequired("target")
 	if err != nil {
 		log.Fatal(err)
@@ -54,6 +156,21 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	uploadCmd.Flags().StringVarP(&description, "description", "d", "", "Archive description (defaults to the file name)")
+	uploadCmd.Flags().StringVar(&archiveFormat, "archive", "", "Bundle a directory into a single archive of the given format (tar)")
+	uploadCmd.Flags().StringVar(&compress, "compress", "", "Compress archives before uploading them ("+codecNames()+")")
+	uploadCmd.Flags().BoolVar(&encrypt, "encrypt", false, "Encrypt archives with a local key or passphrase before uploading them")
+	uploadCmd.Flags().StringVar(&keyFile, "key-file", "", "File holding a 32 byte encryption key, raw or hex encoded")
+	uploadCmd.Flags().StringVar(&passphraseFile, "passphrase-file", "", "File holding the encryption passphrase (also read from $"+passphraseEnv+" or prompted for)")
+	uploadCmd.Flags().StringVar(&kmsKeyID, "kms-key-id", "", "Encrypt archives with data keys from this KMS key instead of --encrypt")
+	uploadCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 4, "Number of requests to have in flight at once, across all files")
+	uploadCmd.Flags().StringVar(&order, "order", "name", "Order to upload a directory's files in (name, largest, smallest)")
+	uploadCmd.Flags().Int64Var(&partSizeMiB, "part-size", 0, "Part size in MiB, a power of two from 1 to 4096 (default picks the smallest that fits)")
+	uploadCmd.Flags().Int64Var(&thresholdMiB, "multipart-threshold", 100, "Files smaller than this many MiB are uploaded in a single request")
+	uploadCmd.Flags().BoolVar(&resume, "resume", false, "Continue an interrupted upload from its local journal")
+	uploadCmd.Flags().StringVar(&resumeUploadID, "resume-upload-id", "", "Continue an upload using the parts Glacier already has")
+	uploadCmd.Flags().IntVar(&maxAttempts, "max-attempts", 5, "Maximum number of times to try uploading each part")
 }
 
 // Just the filepaths of the files to get uploaded
@@ -90,98 +207,431 @@ func getFiles(fp string, files map[string]struct{}) {
 	files[fp] = struct{}{}
 }
 
-func uploadFileMultipart(svc *glacier.Glacier, fp string) error {
-	partSize := int64(1 << 20) // 1MB
-	baseName := filepath.Base(fp)
-
-	initResult, err := svc.InitiateMultipartUpload(&glacier.InitiateMultipartUploadInput{
-		AccountId:          aws.String("-"),
-		ArchiveDescription: aws.String(baseName),
-		PartSize:           aws.String(fmt.Sprintf("%d", partSize)),
-		VaultName:          aws.String(vault),
+// sortFiles puts the files in the order they should be uploaded and adds up
+// their sizes.
+func sortFiles(files map[string]struct{}, order string) ([]string, int64, error) {
+	sizes := make(map[string]int64, len(files))
+	var sorted []string
+	var totalSize int64
+	for fp := range files {
+		stats, err := os.Stat(fp)
+		if err != nil {
+			return nil, 0, err
+		}
+		sizes[fp] = stats.Size()
+		totalSize += stats.Size()
+		sorted = append(sorted, fp)
+	}
+
+	var less func(a, b string) bool
+	switch order {
+	case "name":
+		less = func(a, b string) bool { return a < b }
+	case "largest":
+		less = func(a, b string) bool { return sizes[a] > sizes[b] }
+	case "smallest":
+		less = func(a, b string) bool { return sizes[a] < sizes[b] }
+	default:
+		return nil, 0, fmt.Errorf("invalid order: %s", order)
+	}
+
+	// ties fall back to the name so the order is always the same
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if less(a, b) || less(b, a) {
+			return less(a, b)
+		}
+		return a < b
+	})
+	return sorted, totalSize, nil
+}
+
+// uploadFiles uploads as many files at once as the request budget allows,
+// starting them in the given order. Every file is attempted even if some fail.
+func uploadFiles(svc *glacier.Glacier, files []string) error {
+	queue := make(chan string)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fp := range queue {
+				if err := uploadFile(svc, fp); err != nil {
+					uploads.printf("%s failed | %s\n", fp, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, fp := range files {
+		queue <- fp
+	}
+	close(queue)
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d file(s) failed to upload", failed, len(files))
+	}
+	return nil
+}
+
+// newArchiveMetadata records how the archive is uploaded, under the
+// --description flag if one was given, otherwise the file's name.
+func newArchiveMetadata(fp string) archiveMetadata {
+	m := archiveMetadata{
+		Name:     filepath.Base(fp),
+		Compress: compress,
+	}
+	if encrypt || kmsKeyID != "" {
+		m.Encrypt = encryptionName
+	}
+	if description != "" {
+		m.Name = description
+	}
+	return m
+}
+
+// uploadFile sends small files in one request and everything else in parts.
+func uploadFile(svc *glacier.Glacier, fp string) error {
+	stats, err := os.Stat(fp)
+	if err != nil {
+		return err
+	}
+
+	if transformed() {
+		f, err := os.Open(fp)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return uploadReader(svc, f, fp, fp)
+	}
+
+	if stats.Size() == 0 {
+		return errEmptyArchive
+	}
+
+	if resumeUploadID == "" && stats.Size() < thresholdMiB<<20 {
+		return uploadFileSingle(svc, fp)
+	}
+	return uploadFileMultipart(svc, fp)
+}
+
+func uploadFileSingle(svc *glacier.Glacier, fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	desc, err := newArchiveMetadata(fp).description()
+	if err != nil {
+		return err
+	}
+
+	stats, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	bar := uploads.newBar(filepath.Base(fp), stats.Size())
+	defer bar.Finish()
+
+	hashes := glacier.ComputeHashes(f)
+
+	budget.acquire(nil)
+	defer budget.release()
+
+	var result *glacier.ArchiveCreationOutput
+	err = withRetries(maxAttempts, func() error {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		var err error
+		result, err = svc.UploadArchiveWithContext(aws.BackgroundContext(), &glacier.UploadArchiveInput{
+			AccountId:          aws.String("-"),
+			ArchiveDescription: aws.String(desc),
+			Body:               f,
+			Checksum:           aws.String(fmt.Sprintf("%x", hashes.TreeHash)),
+			VaultName:          aws.String(vault),
+		}, noSDKRetries)
+		return err
 	})
 	if err != nil {
 		return formatAWSError(err)
 	}
 
+	bar.Add64(stats.Size())
+	uploads.printf("%s\n", result)
+	return recordUpload(result, desc, stats.Size(), fmt.Sprintf("%x", hashes.TreeHash), fp)
+}
+
+func uploadFileMultipart(svc *glacier.Glacier, fp string) error {
 	f, err := os.Open(fp)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	// TODO: zip the file first
+	stats, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	totalSize := stats.Size()
 
-	var th treehash.MultiTreeHash
+	partSize, err := selectPartSize(totalSize, partSizeMiB)
+	if err != nil {
+		return fmt.Errorf("%s | %s", fp, err)
+	}
 
-	var totalSize int64
-	if stats, err := f.Stat(); err == nil {
-		totalSize = stats.Size()
-	} else {
+	jf, err := journalFile(vault, fp)
+	if err != nil {
+		return err
+	}
+	j, err := loadJournal(jf)
+	if err != nil {
 		return err
 	}
 
-	bar := pb.ProgressBarTemplate(fmt.Sprintf(`%s: {{bar . | green}} {{counters . | blue }}`, baseName)).Start64(totalSize)
+	switch {
+	case resumeUploadID != "":
+		j, err = journalFromParts(svc, jf, resumeUploadID, f, stats)
+		if err != nil {
+			return err
+		}
+		if err := j.save(); err != nil {
+			return err
+		}
+		partSize = j.PartSize
+		uploads.printf("Resuming upload %s (%d part(s) verified)\n", j.UploadID, len(j.Parts))
+	case j != nil && resume:
+		if err := j.matches(stats); err != nil {
+			return err
+		}
+		partSize = j.PartSize
+		uploads.printf("Resuming upload %s (%d part(s) already uploaded)\n", j.UploadID, len(j.Parts))
+	default:
+		if j != nil {
+			uploads.printf("Ignoring unfinished upload %s of %s, use --resume to continue it\n", j.UploadID, fp)
+		}
 
-	startB := int64(0)
-	var wg sync.WaitGroup
-	for {
-		wg.Add(1)
+		desc, err := newArchiveMetadata(fp).description()
+		if err != nil {
+			return err
+		}
 
-		// either the part size, or the amount of file remaining, whichever is smaller
-		contentLength := int(math.Min(float64(partSize), float64(totalSize-startB)))
-		buf := make([]byte, contentLength)
-		n, _ := io.ReadFull(f, buf)
-		if n == 0 {
-			wg.Done()
-			break
-		}
-
-		endB := startB + int64(n)
-
-		hash := fmt.Sprintf("%x", sha256.Sum256(buf[:n]))
-		th.Add(hash)
-
-		go func(b []byte, s int64, e int64, h string) {
-			_, err := svc.UploadMultipartPart(&glacier.UploadMultipartPartInput{
-				AccountId: aws.String("-"),
-				Body:      bytes.NewReader(buf),
-				Checksum:  aws.String(h),
-				Range:     aws.String(fmt.Sprintf("bytes %d-%d/*", s, e-1)),
-				UploadId:  aws.String(*initResult.UploadId),
-				VaultName: aws.String(vault),
-			})
-			if err != nil {
-				// TODO: queue the part to be reuploaded
-				panic(formatAWSError(err))
-			}
-			bar.Add(contentLength)
-			wg.Done()
-		}(buf, startB, endB, hash)
+		uploadID, err := initiateUpload(svc, desc, partSize)
+		if err != nil {
+			return err
+		}
 
-		startB = endB
+		j = newJournal(jf, uploadID, desc, fp, stats, partSize)
+		if err := j.save(); err != nil {
+			return err
+		}
 	}
 
-	wg.Wait()
+	bar := uploads.newBar(filepath.Base(fp), totalSize)
 
-	input := &glacier.CompleteMultipartUploadInput{
-		AccountId:   aws.String("-"),
-		ArchiveSize: aws.String(fmt.Sprintf("%d", totalSize)),
-		Checksum:    aws.String(th.Hash()),
-		UploadId:    aws.String(*initResult.UploadId),
-		VaultName:   aws.String(vault),
+	u := &multipartUpload{
+		svc:      svc,
+		uploadID: j.UploadID,
+		partSize: partSize,
+		uploaded: j.uploaded(),
+		onPart:   j.done,
+		bar:      bar,
 	}
-	result, err := svc.CompleteMultipartUpload(input)
+	_, treeHash, err := u.send(f, totalSize)
 	if err != nil {
-		return formatAWSError(err)
+		bar.Finish()
+		return fmt.Errorf("%s | run again with --resume to continue upload %s", err, j.UploadID)
 	}
 
+	result, err := u.complete(totalSize, treeHash)
 	bar.Finish()
+	if err != nil {
+		return err
+	}
+
+	if err := j.remove(); err != nil {
+		return err
+	}
 
 	// TODO: sync the archive with an S3 bucket
-	fmt.Println(result)
-	fmt.Println(*initResult.UploadId)
+	uploads.printf("%s\n%s\n", result, j.UploadID)
 
-	return nil
+	return recordUpload(result, j.Description, totalSize, treeHash, fp)
+}
+
+// transformed is true when archives are compressed or encrypted, which means
+// they have to be streamed.
+func transformed() bool {
+	return compress != "" || encrypt || kmsKeyID != ""
+}
+
+// uploadReader streams r up as a single archive called name, compressing and
+// encrypting it first if asked to. fp is the local file or directory r comes
+// from, if any.
+func uploadReader(svc *glacier.Glacier, r io.Reader, name string, fp string) error {
+	m := newArchiveMetadata(name)
+
+	if compress != "" {
+		cr, err := compressStream(r, compress)
+		if err != nil {
+			return err
+		}
+		defer cr.Close()
+		r = cr
+	}
+
+	if m.Encrypt != "" {
+		var (
+			key []byte
+			h   encryptionHeader
+			err error
+		)
+		if kmsKeyID != "" {
+			h = newKMSHeader()
+			key, m.KMSKey, err = kmsDataKey(kmsSvc, kmsKeyID)
+		} else {
+			h, err = keys.newHeader()
+			if err == nil {
+				key, err = keys.archiveKey(h)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		er, err := encryptStream(r, key, h)
+		if err != nil {
+			return err
+		}
+		defer er.Close()
+		r = er
+	}
+
+	desc, err := m.description()
+	if err != nil {
+		return err
+	}
+
+	return uploadStream(svc, r, desc, fp)
+}
+
+// uploadStream sends everything read from r as a single archive. Nothing is
+// journaled since a stream can't be read twice, so a failed upload is aborted.
+func uploadStream(svc *glacier.Glacier, r io.Reader, desc string, fp string) error {
+	partSize := streamPartSize
+	if partSizeMiB != 0 {
+		var err error
+		partSize, err = selectPartSize(0, partSizeMiB)
+		if err != nil {
+			return err
+		}
+	}
+
+	// find out about empty input before there's an upload to abort
+	br := bufio.NewReaderSize(r, 64<<10)
+	if _, err := br.Peek(1); err == io.EOF {
+		return errEmptyArchive
+	} else if err != nil {
+		return err
+	}
+	r = br
+
+	uploadID, err := initiateUpload(svc, desc, partSize)
+	if err != nil {
+		return err
+	}
+
+	bar := uploads.newBar(parseDescription(desc).Name, 0)
+
+	u := &multipartUpload{
+		svc:      svc,
+		uploadID: uploadID,
+		partSize: partSize,
+		bar:      bar,
+	}
+	size, treeHash, err := u.send(r, -1)
+	if err != nil {
+		bar.Finish()
+		u.abort()
+		return err
+	}
+
+	result, err := u.complete(size, treeHash)
+	bar.Finish()
+	if err != nil {
+		return err
+	}
+
+	uploads.printf("%s\n", result)
+	return recordUpload(result, desc, size, treeHash, fp)
+}
+
+// journalFromParts rebuilds a journal from the parts Glacier already has for an
+// upload. Parts that don't match the local file are left out so that they get
+// sent again.
+func journalFromParts(svc *glacier.Glacier, jf string, uploadID string, f *os.File, stats os.FileInfo) (*journal, error) {
+	var j *journal
+	var verifyErr error
+	err := svc.ListPartsPages(&glacier.ListPartsInput{
+		AccountId: aws.String("-"),
+		UploadId:  aws.String(uploadID),
+		VaultName: aws.String(vault),
+	}, func(page *glacier.ListPartsOutput, lastPage bool) bool {
+		if j == nil {
+			j = newJournal(jf, uploadID, aws.StringValue(page.ArchiveDescription), f.Name(), stats, aws.Int64Value(page.PartSizeInBytes))
+			if j.PartSize <= 0 {
+				verifyErr = fmt.Errorf("could not determine the part size of upload %s", uploadID)
+				return false
+			}
+		}
+
+		for _, p := range page.Parts {
+			var start, end int64
+			_, err := fmt.Sscanf(aws.StringValue(p.RangeInBytes), "%d-%d", &start, &end)
+			if err != nil {
+				verifyErr = fmt.Errorf("unexpected part range %q | %s", aws.StringValue(p.RangeInBytes), err)
+				return false
+			}
+
+			// only whole parts lined up the way this upload splits the file are reusable
+			expectedEnd := start + j.PartSize
+			if expectedEnd > j.Size {
+				expectedEnd = j.Size
+			}
+			if start%j.PartSize != 0 || end+1 != expectedEnd {
+				continue
+			}
+
+			hash := fmt.Sprintf("%x", glacier.ComputeHashes(io.NewSectionReader(f, start, end+1-start)).TreeHash)
+			if hash != aws.StringValue(p.SHA256TreeHash) {
+				continue
+			}
+			j.Parts[start] = hash
+		}
+		return true
+	})
+	if err != nil {
+		return nil, formatAWSError(err)
+	}
+	if verifyErr != nil {
+		return nil, verifyErr
+	}
+	if j == nil {
+		return nil, fmt.Errorf("could not determine the part size of upload %s", uploadID)
+	}
+	return j, nil
 }
 
 func formatAWSError(err error) error {
@@ -201,5 +651,5 @@ func formatAWSError(err error) error {
 			return fmt.Errorf("%s", aerr.Error())
 		}
 	}
-	return fmt.Errorf(err.Error())
+	return err
 }
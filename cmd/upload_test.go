@@ -1 +1,178 @@
 package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+func TestSelectPartSize(t *testing.T) {
+	tests := []struct {
+		totalSize int64
+		mib       int64
+		expected  int64
+		fails     bool
+	}{
+		{totalSize: 0, expected: 1 << 20},
+		{totalSize: 3 << 10, expected: 1 << 20},
+		{totalSize: maxParts << 20, expected: 1 << 20},
+		{totalSize: maxParts<<20 + 1, expected: 2 << 20},
+		{totalSize: 50 << 30, expected: 8 << 20},
+		{totalSize: maxArchiveSize, expected: maxPartSize},
+		{totalSize: maxArchiveSize + 1, fails: true},
+		{totalSize: 50 << 30, mib: 64, expected: 64 << 20},
+		{totalSize: 50 << 30, mib: 4, fails: true},
+		{totalSize: 1 << 20, mib: 3, fails: true},
+		{totalSize: 1 << 20, mib: 8192, fails: true},
+		{totalSize: 1 << 20, mib: -1, fails: true},
+	}
+
+	for _, test := range tests {
+		partSize, err := selectPartSize(test.totalSize, test.mib)
+		if test.fails {
+			if err == nil {
+				t.Errorf("selectPartSize(%d, %d) should have failed, got %d", test.totalSize, test.mib, partSize)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("selectPartSize(%d, %d) failed | %s", test.totalSize, test.mib, err)
+			continue
+		}
+		if partSize != test.expected {
+			t.Errorf("selectPartSize(%d, %d) = %d, expected %d", test.totalSize, test.mib, partSize, test.expected)
+		}
+	}
+}
+
+func TestJournalFromParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glacier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldVault := vault
+	defer func() { vault = oldVault }()
+	vault = "photos"
+
+	// every part has to be different for a mismatch to show
+	data := make([]byte, 7<<19)
+	rand.New(rand.NewSource(1)).Read(data)
+	fp := filepath.Join(dir, "big.bin")
+	if err := ioutil.WriteFile(fp, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stats, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func(start, end int64) string {
+		return fmt.Sprintf("%x", glacier.ComputeHashes(bytes.NewReader(data[start:end])).TreeHash)
+	}
+	mib := minPartSize
+
+	tests := []struct {
+		name     string
+		partSize int64
+		parts    map[string]string
+		// starts of the parts that should be kept, or nil if it should fail
+		expected []int64
+	}{
+		{
+			name:     "matching",
+			partSize: mib,
+			parts: map[string]string{
+				fmt.Sprintf("0-%d", mib-1):           hash(0, mib),
+				fmt.Sprintf("%d-%d", 3*mib, 7<<19-1): hash(3*mib, 7<<19),
+			},
+			expected: []int64{0, 3 * mib},
+		},
+		{
+			name:     "mismatched",
+			partSize: mib,
+			parts: map[string]string{
+				fmt.Sprintf("0-%d", mib-1):         hash(0, mib),
+				fmt.Sprintf("%d-%d", mib, 2*mib-1): hash(0, mib),
+			},
+			expected: []int64{0},
+		},
+		{
+			name:     "misaligned",
+			partSize: mib,
+			parts: map[string]string{
+				fmt.Sprintf("%d-%d", 512, mib+511):    hash(512, mib+512),
+				fmt.Sprintf("%d-%d", 2*mib, 2*mib+99): hash(2*mib, 2*mib+100),
+			},
+			expected: []int64{},
+		},
+		{
+			name:     "no part size",
+			partSize: 0,
+			parts: map[string]string{
+				fmt.Sprintf("0-%d", mib-1): hash(0, mib),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var parts []*glacier.PartListElement
+		for r, h := range test.parts {
+			parts = append(parts, &glacier.PartListElement{RangeInBytes: aws.String(r), SHA256TreeHash: aws.String(h)})
+		}
+		body, err := json.Marshal(&glacier.ListPartsOutput{
+			ArchiveDescription: aws.String("big.bin"),
+			PartSizeInBytes:    aws.Int64(test.partSize),
+			Parts:              parts,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		svc, closeServer := testGlacier(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		}))
+		j, err := journalFromParts(svc, filepath.Join(dir, "journal.json"), "upload", f, stats)
+		closeServer()
+
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%s: journalFromParts should have failed", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: journalFromParts failed | %s", test.name, err)
+			continue
+		}
+
+		var starts []int64
+		for start := range j.Parts {
+			starts = append(starts, start)
+		}
+		sort.Slice(starts, func(a, b int) bool { return starts[a] < starts[b] })
+		if fmt.Sprint(starts) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: parts = %v, expected %v", test.name, starts, test.expected)
+		}
+		if j.PartSize != test.partSize || j.Description != "big.bin" {
+			t.Errorf("%s: part size = %d, description = %s, expected %d, big.bin", test.name, j.PartSize, j.Description, test.partSize)
+		}
+	}
+}
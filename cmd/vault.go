@@ -0,0 +1,401 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/spf13/cobra"
+)
+
+var (
+	vaultOutput string
+	vaultTags   []string
+)
+
+var vaultCmd = &cobra.Command{
+	Use:   "vault",
+	Short: "Create, inspect, tag and delete vaults",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var vaultCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a vault and wait for it to exist",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		result, err := svc.CreateVault(&glacier.CreateVaultInput{
+			AccountId: aws.String("-"),
+			VaultName: aws.String(vault),
+		})
+		if err != nil {
+			return formatAWSError(err)
+		}
+
+		err = svc.WaitUntilVaultExists(&glacier.DescribeVaultInput{
+			AccountId: aws.String("-"),
+			VaultName: aws.String(vault),
+		})
+		if err != nil {
+			return formatAWSError(err)
+		}
+
+		fmt.Println(aws.StringValue(result.Location))
+		return nil
+	},
+}
+
+var vaultDescribeCmd = &cobra.Command{
+	Use:   "describe",
+	Short: "Show a vault's archive count, size and last inventory date",
+	Long: `Glacier only updates the archive count and size when it takes an inventory of
+the vault, roughly once a day.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var desc *glacier.DescribeVaultOutput
+		err := withRetries(maxAttempts, func() error {
+			var err error
+			desc, err = svc.DescribeVaultWithContext(aws.BackgroundContext(), &glacier.DescribeVaultInput{
+				AccountId: aws.String("-"),
+				VaultName: aws.String(vault),
+			}, noSDKRetries)
+			return err
+		})
+		if err != nil {
+			return formatAWSError(err)
+		}
+
+		return printVaults([]*glacier.DescribeVaultOutput{desc}, vaultOutput)
+	},
+}
+
+var vaultListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the vaults in the region",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		vaults, err := listVaults()
+		if err != nil {
+			return err
+		}
+
+		if len(vaultTags) > 0 {
+			want, err := parseTags(vaultTags)
+			if err != nil {
+				return err
+			}
+			if vaults, err = filterVaults(vaults, want); err != nil {
+				return err
+			}
+		}
+
+		return printVaults(vaults, vaultOutput)
+	},
+}
+
+var vaultDeleteCmd = &cobra.Command{
+	Use:   "delete",
+	Short: "Delete an empty vault and wait for it to be gone",
+	Long: `Glacier only deletes vaults that had no archives as of their last inventory and
+haven't been written to since. The local inventory of the vault is removed too,
+the catalog of uploads is kept.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, err := svc.DeleteVault(&glacier.DeleteVaultInput{
+			AccountId: aws.String("-"),
+			VaultName: aws.String(vault),
+		})
+		if err != nil {
+			return formatAWSError(err)
+		}
+
+		err = svc.WaitUntilVaultNotExists(&glacier.DescribeVaultInput{
+			AccountId: aws.String("-"),
+			VaultName: aws.String(vault),
+		})
+		if err != nil {
+			return formatAWSError(err)
+		}
+
+		file, err := snapshotFile(region, vault)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		fmt.Printf("Deleted %s\n", vault)
+		return nil
+	},
+}
+
+var vaultTagsCmd = &cobra.Command{
+	Use:   "tags",
+	Short: "Manage a vault's tags",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var vaultTagsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List a vault's tags",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tags, err := tagsForVault(vault)
+		if err != nil {
+			return err
+		}
+
+		switch vaultOutput {
+		case "table":
+			keys := make([]string, 0, len(tags))
+			for k := range tags {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "KEY\tVALUE")
+			for _, k := range keys {
+				fmt.Fprintf(w, "%s\t%s\n", k, tags[k])
+			}
+			return w.Flush()
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(tags)
+		default:
+			return fmt.Errorf("invalid output: %s", vaultOutput)
+		}
+	},
+}
+
+var vaultTagsAddCmd = &cobra.Command{
+	Use:   "add <key=value>...",
+	Short: "Add tags to a vault, replacing the values of keys it already has",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tags, err := parseTags(args)
+		if err != nil {
+			return err
+		}
+
+		input := &glacier.AddTagsToVaultInput{
+			AccountId: aws.String("-"),
+			Tags:      make(map[string]*string, len(tags)),
+			VaultName: aws.String(vault),
+		}
+		for k, v := range tags {
+			input.Tags[k] = aws.String(v)
+		}
+
+		if _, err := svc.AddTagsToVault(input); err != nil {
+			return formatAWSError(err)
+		}
+		return nil
+	},
+}
+
+var vaultTagsRemoveCmd = &cobra.Command{
+	Use:   "remove <key>...",
+	Short: "Remove tags from a vault",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, err := svc.RemoveTagsFromVault(&glacier.RemoveTagsFromVaultInput{
+			AccountId: aws.String("-"),
+			TagKeys:   aws.StringSlice(args),
+			VaultName: aws.String(vault),
+		})
+		if err != nil {
+			return formatAWSError(err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	vaultCmd.AddCommand(
+		vaultCreateCmd,
+		vaultDescribeCmd,
+		vaultListCmd,
+		vaultDeleteCmd,
+		vaultTagsCmd,
+	)
+
+	vaultTagsCmd.AddCommand(
+		vaultTagsListCmd,
+		vaultTagsAddCmd,
+		vaultTagsRemoveCmd,
+	)
+
+	for _, c := range []*cobra.Command{vaultCreateCmd, vaultDescribeCmd, vaultDeleteCmd, vaultTagsListCmd, vaultTagsAddCmd, vaultTagsRemoveCmd} {
+		c.Flags().StringVarP(&vault, "vault", "v", "", "Vault name")
+		err := c.MarkFlagRequired("vault")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, c := range []*cobra.Command{vaultDescribeCmd, vaultListCmd, vaultTagsListCmd} {
+		c.Flags().StringVarP(&vaultOutput, "output", "o", "table", "Output format (table, json)")
+		c.Flags().IntVar(&maxAttempts, "max-attempts", 5, "Maximum number of times to try each request")
+	}
+
+	vaultListCmd.Flags().StringSliceVar(&vaultTags, "vault-tag", nil, "Only vaults with this tag, as key=value (can be repeated, all have to match)")
+}
+
+// listVaults returns every vault in the region.
+func listVaults() ([]*glacier.DescribeVaultOutput, error) {
+	var vaults []*glacier.DescribeVaultOutput
+	err := svc.ListVaultsPages(&glacier.ListVaultsInput{
+		AccountId: aws.String("-"),
+	}, func(page *glacier.ListVaultsOutput, lastPage bool) bool {
+		vaults = append(vaults, page.VaultList...)
+		return true
+	})
+	if err != nil {
+		return nil, formatAWSError(err)
+	}
+	return vaults, nil
+}
+
+func printVaults(vaults []*glacier.DescribeVaultOutput, output string) error {
+	switch output {
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tARCHIVES\tSIZE\tCREATED\tLAST INVENTORY\tARN")
+		for _, v := range vaults {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n",
+				aws.StringValue(v.VaultName),
+				aws.Int64Value(v.NumberOfArchives),
+				formatSize(aws.Int64Value(v.SizeInBytes)),
+				aws.StringValue(v.CreationDate),
+				aws.StringValue(v.LastInventoryDate),
+				aws.StringValue(v.VaultARN),
+			)
+		}
+		return w.Flush()
+	case "json":
+		type vaultJSON struct {
+			Name              string `json:"name"`
+			ARN               string `json:"arn"`
+			Archives          int64  `json:"archives"`
+			Size              int64  `json:"size"`
+			CreationDate      string `json:"creation_date"`
+			LastInventoryDate string `json:"last_inventory_date,omitempty"`
+		}
+
+		out := []vaultJSON{}
+		for _, v := range vaults {
+			out = append(out, vaultJSON{
+				Name:              aws.StringValue(v.VaultName),
+				ARN:               aws.StringValue(v.VaultARN),
+				Archives:          aws.Int64Value(v.NumberOfArchives),
+				Size:              aws.Int64Value(v.SizeInBytes),
+				CreationDate:      aws.StringValue(v.CreationDate),
+				LastInventoryDate: aws.StringValue(v.LastInventoryDate),
+			})
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	default:
+		return fmt.Errorf("invalid output: %s", output)
+	}
+}
+
+// tagsForVault returns the vault's tags.
+func tagsForVault(name string) (map[string]string, error) {
+	var result *glacier.ListTagsForVaultOutput
+	err := withRetries(maxAttempts, func() error {
+		var err error
+		result, err = svc.ListTagsForVaultWithContext(aws.BackgroundContext(), &glacier.ListTagsForVaultInput{
+			AccountId: aws.String("-"),
+			VaultName: aws.String(name),
+		}, noSDKRetries)
+		return err
+	})
+	if err != nil {
+		return nil, formatAWSError(err)
+	}
+	return aws.StringValueMap(result.Tags), nil
+}
+
+// parseTags reads key=value pairs. Values can be empty, keys can't.
+func parseTags(pairs []string) (map[string]string, error) {
+	tags := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid tag: %s (expected key=value)", pair)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags, nil
+}
+
+// filterVaults keeps the vaults that have every one of the wanted tags.
+func filterVaults(vaults []*glacier.DescribeVaultOutput, want map[string]string) ([]*glacier.DescribeVaultOutput, error) {
+	var matched []*glacier.DescribeVaultOutput
+	for _, v := range vaults {
+		tags, err := tagsForVault(aws.StringValue(v.VaultName))
+		if err != nil {
+			return nil, err
+		}
+		if hasTags(tags, want) {
+			matched = append(matched, v)
+		}
+	}
+	return matched, nil
+}
+
+func hasTags(tags map[string]string, want map[string]string) bool {
+	for k, v := range want {
+		if have, ok := tags[k]; !ok || have != v {
+			return false
+		}
+	}
+	return true
+}
+
+// selectedVaults is the vault given with --vault, or every vault with the tags
+// given with --vault-tag.
+func selectedVaults() ([]string, error) {
+	if len(vaultTags) == 0 {
+		if vault == "" {
+			return nil, fmt.Errorf("either --vault or --vault-tag is required")
+		}
+		return []string{vault}, nil
+	}
+	if vault != "" {
+		return nil, fmt.Errorf("--vault and --vault-tag can't be used together")
+	}
+
+	want, err := parseTags(vaultTags)
+	if err != nil {
+		return nil, err
+	}
+
+	vaults, err := listVaults()
+	if err != nil {
+		return nil, err
+	}
+	if vaults, err = filterVaults(vaults, want); err != nil {
+		return nil, err
+	}
+	if len(vaults) == 0 {
+		return nil, fmt.Errorf("no vaults are tagged %s", strings.Join(vaultTags, ", "))
+	}
+
+	names := make([]string, 0, len(vaults))
+	for _, v := range vaults {
+		names = append(names, aws.StringValue(v.VaultName))
+	}
+	return names, nil
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import "testing"
+
+func TestParseTags(t *testing.T) {
+	tags, err := parseTags([]string{"team=data", "cost-center=42", "note=a=b", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"team": "data", "cost-center": "42", "note": "a=b", "empty": ""}
+	if len(tags) != len(expected) {
+		t.Errorf("parseTags found %d tag(s), expected %d", len(tags), len(expected))
+	}
+	for k, v := range expected {
+		if tags[k] != v {
+			t.Errorf("tag %s = %q, expected %q", k, tags[k], v)
+		}
+	}
+
+	for _, pair := range []string{"team", "=data", ""} {
+		if _, err := parseTags([]string{pair}); err == nil {
+			t.Errorf("parseTags(%q) should have failed", pair)
+		}
+	}
+
+	if !hasTags(tags, map[string]string{"team": "data", "empty": ""}) {
+		t.Errorf("hasTags should match a subset of the tags")
+	}
+	if hasTags(tags, map[string]string{"team": "ops"}) || hasTags(tags, map[string]string{"owner": ""}) {
+		t.Errorf("hasTags should need every wanted tag to match")
+	}
+}